@@ -0,0 +1,44 @@
+package eventsource
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// ChannelWriter returns an io.Writer that publishes each line written to it as an event with no ID or
+// event type, whose data is the line without its line ending, to a channel. This can be used, for example,
+// as the output of a log.Logger to stream log messages to browsers.
+//
+// A line is published once its newline has been written, so the writer keeps any text after the last
+// newline until a later Write completes it. It is safe to call Write from multiple goroutines, but the
+// lines of concurrent writes may be interleaved unless each Write contains whole lines.
+func (srv *Server) ChannelWriter(channel string) io.Writer {
+	return &channelWriter{srv: srv, channels: []string{channel}}
+}
+
+type channelWriter struct {
+	srv      *Server
+	channels []string
+	lock     sync.Mutex
+	partial  []byte // the text after the last newline, which has not been published yet
+}
+
+func (w *channelWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimSuffix(w.partial[:i], []byte("\r"))
+		w.srv.Publish(w.channels, &publication{data: string(line)})
+		w.partial = w.partial[i+1:]
+	}
+	if len(w.partial) == 0 {
+		w.partial = nil // so that the array of a large write isn't kept
+	}
+	return len(p), nil
+}
@@ -0,0 +1,42 @@
+package eventsource
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelWriterPublishesEachLine(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	connectedCh := make(chan struct{}, 1)
+	server.OnConnect = func(string, string) { connectedCh <- struct{}{} }
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	<-connectedCh
+
+	w := server.ChannelWriter("test")
+	_, err = io.WriteString(w, "first\nsecond\r\nthi")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "rd\n\nincomplete")
+	require.NoError(t, err)
+	log.New(server.ChannelWriter("test"), "", 0).Print("logged")
+
+	events, err := ReadEvents(resp.Body, 4)
+	require.NoError(t, err)
+	var data []string
+	for _, ev := range events {
+		data = append(data, ev.Data())
+	}
+	// The empty line is published too, but ReadEvents skips events without fields
+	assert.Equal(t, []string{"first", "second", "third", "logged"}, data)
+}
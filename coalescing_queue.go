@@ -0,0 +1,118 @@
+package eventsource
+
+import "sync"
+
+// coalescingQueue holds the events and comments waiting to be sent to a subscriber when Server.Coalesce is
+// set. Unlike a buffered channel, it lets the Server replace a waiting event with a newer one of the same
+// type, so a subscriber that falls behind skips intermediate states instead of being disconnected.
+type coalescingQueue struct {
+	items   []eventOrComment
+	limit   int
+	closed  bool
+	stopped bool
+	readyCh chan struct{}
+	stopCh  chan struct{} // closed by stop
+	lock    sync.Mutex
+}
+
+func newCoalescingQueue(limit int) *coalescingQueue {
+	if limit < 1 {
+		limit = 1
+	}
+	return &coalescingQueue{limit: limit, readyCh: make(chan struct{}, 1), stopCh: make(chan struct{})}
+}
+
+// Returns the number of items in the queue and the maximum number.
+func (q *coalescingQueue) stats() (int, int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.items), q.limit
+}
+
+// Adds an item to the end of the queue. If it is an event with a non-empty type, any waiting event of the
+// same type is removed first. Returns false if the queue already holds the maximum number of items.
+func (q *coalescingQueue) push(ec eventOrComment) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if ev, ok := ec.(Event); ok && ev.Event() != "" {
+		for i, item := range q.items {
+			if waiting, ok := item.(Event); ok && waiting.Event() == ev.Event() {
+				q.items = append(q.items[:i], q.items[i+1:]...)
+				break // there can't be more than one, since each push removes the previous one
+			}
+		}
+	}
+	if len(q.items) >= q.limit {
+		return false
+	}
+	q.items = append(q.items, ec)
+	q.signal()
+	return true
+}
+
+// Marks the queue as closed. Items that are already waiting are still delivered.
+func (q *coalescingQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.signal()
+}
+
+// Makes pump return, leaving any items that it has not sent in the queue. It is safe to call more than once.
+func (q *coalescingQueue) stop() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.stopped {
+		q.stopped = true
+		close(q.stopCh)
+	}
+}
+
+// Removes and returns all the items in the queue.
+func (q *coalescingQueue) drain() []eventOrComment {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	items := q.items
+	q.items = nil
+	return items
+}
+
+func (q *coalescingQueue) signal() {
+	select {
+	case q.readyCh <- struct{}{}:
+	default:
+	}
+}
+
+// Sends the queued items to out one at a time, and closes out once the queue is closed and empty, or once
+// stop is called; the handler does that when it exits.
+func (q *coalescingQueue) pump(out chan<- eventOrComment) {
+	defer close(out)
+	for {
+		q.lock.Lock()
+		if len(q.items) == 0 {
+			closed := q.closed
+			q.lock.Unlock()
+			if closed {
+				return
+			}
+			select {
+			case <-q.readyCh:
+				continue
+			case <-q.stopCh:
+				return
+			}
+		}
+		ec := q.items[0]
+		q.items = q.items[1:]
+		q.lock.Unlock()
+		select {
+		case out <- ec:
+		case <-q.stopCh:
+			q.lock.Lock()
+			q.items = append([]eventOrComment{ec}, q.items...) // so that drain still returns it
+			q.lock.Unlock()
+			return
+		}
+	}
+}
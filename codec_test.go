@@ -65,3 +65,28 @@ func TestEncodeUnknownValue(t *testing.T) {
 		t.Error("Expected error")
 	}
 }
+
+func TestBinaryEventRoundTrip(t *testing.T) {
+	payload := []byte{0, 1, 2, '\n', 0xfe, 0xff}
+	buf := new(bytes.Buffer)
+	if err := NewEncoder(buf, false).Encode(NewBinaryEvent("1", "blob", payload)); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "id: 1\nevent: blob\ndata: AAECCv7/\n\n"; buf.String() != expected {
+		t.Errorf("Expected: %q Got: %q", expected, buf.String())
+	}
+	ev, err := NewDecoder(buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeBinaryEvent(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, payload) {
+		t.Errorf("Expected: %v Got: %v", payload, decoded)
+	}
+	if _, err := DecodeBinaryEvent(&testEvent{data: "not base64!"}); err == nil {
+		t.Error("Expected an error for data that isn't base64")
+	}
+}
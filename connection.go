@@ -0,0 +1,594 @@
+package eventsource
+
+import (
+	"context"
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// retryJitterRandom supplies the random part of each stream's retry directive. It is seeded explicitly,
+	// since the global source in math/rand is not seeded before Go 1.20, so every process would use the same
+	// delays.
+	retryJitterRandom     = newRetryJitterRandom() //nolint:gochecknoglobals // non-exported, shared by all Servers
+	retryJitterRandomLock sync.Mutex               //nolint:gochecknoglobals // guards retryJitterRandom
+)
+
+func newRetryJitterRandom() *mathrand.Rand {
+	return mathrand.New(mathrand.NewSource(time.Now().UnixNano())) //nolint:gosec // doesn't need to be secure
+}
+
+// Returns a pseudo-random duration in [0, limit), which must be positive.
+func randomRetryJitter(limit time.Duration) time.Duration {
+	retryJitterRandomLock.Lock()
+	defer retryJitterRandomLock.Unlock()
+	return time.Duration(retryJitterRandom.Int63n(int64(limit)))
+}
+
+// connection is the state of a single stream, from when the Server accepts its subscription until the
+// handler returns. Its methods are only called from the handler's goroutine.
+//
+// The handler works as follows:
+//   - Normally, it is reading from eventCh. Server.run() accesses this channel through sub.out and sends
+//     published events to it.
+//   - However, if a Repository is being used, the Server might get a whole batch of events that the
+//     Repository provides through its Replay method. The Repository provides these in the form of a channel
+//     that it writes to. Since we don't know how many events there will be or how long it will take to write
+//     them, we do not want to block Server.run() for this.
+//   - Previous implementations of sending events from Replay used a separate goroutine. That was unsafe, due
+//     to a race condition where Server.run() might close the channel while the Replay goroutine is still
+//     writing to it.
+//   - So, instead, Server.run() now takes the channel from Replay and wraps it in an eventBatch. When the
+//     handler sees an eventBatch, it switches over to reading events from that channel until the channel is
+//     closed. Then it switches back to reading events from the regular channel.
+//   - The Server can close eventCh at any time to indicate that the stream is done. The handler exits.
+//   - If the client closes the connection, or if MaxConnTime elapses, the handler exits after telling the
+//     Server to stop publishing events to it.
+type connection struct {
+	srv      *Server
+	w        http.ResponseWriter
+	req      *http.Request
+	flusher  http.Flusher
+	channel  string // the subscription's channel, which changes when the handler gets a channelSwitched
+	sub      *subscription
+	eventCh  chan eventOrComment
+	queue    *coalescingQueue // if Server.Coalesce is set, the queue whose pump goroutine sends to eventCh
+	opts     handlerOptions
+	encoding Encoding
+	enc      *Encoder
+
+	// If WriteTimeout is set, each write and flush must complete within that time. A client that has stopped
+	// reading is then disconnected as soon as the connection's buffers are full, rather than only once
+	// BufferSize events have piled up behind the blocked write. If DrainTimeout is set, writes after the
+	// Server closes the subscription must also complete before that elapses. noWriteDeadlines is set if the
+	// ResponseWriter doesn't support either.
+	writeTimeout     time.Duration
+	noWriteDeadlines bool
+
+	// If FlushInterval is set, events are written as they arrive but the first one starts a timer, and the
+	// response is only flushed when the timer fires; this batches the flush syscalls at high event rates.
+	flushTimer   *time.Timer
+	flushTimerCh <-chan time.Time
+
+	// If KeepAlive is set, this timer is restarted after every write, so that the empty keep-alive comment is
+	// only sent when nothing else has been sent for that long; busy connections get no extra traffic.
+	keepAliveTimer *time.Timer
+	keepAliveCh    <-chan time.Time
+
+	// If MaxEventsPerSecond is set, live events are only written while the rate limiter allows. Events that
+	// are held back because of CoalesceRateLimited are written when heldTimer fires.
+	limiter     *rateLimiter
+	held        []Event
+	heldTimer   *time.Timer
+	heldTimerCh <-chan time.Time
+
+	// If BufferReplay is set, this is true while events are being replayed: they are written without
+	// flushing either the Encoder or the response until the end of the replay.
+	buffering bool
+
+	readMainCh     <-chan eventOrComment
+	readBatchCh    <-chan Event
+	replay         *replayResult // safe to read once readBatchCh is closed
+	lastReplayedID string
+
+	closedNormally       bool
+	drainTimedOut        bool
+	failedEventOrComment eventOrComment
+	reason               DisconnectReason
+}
+
+func (srv *Server) newConnection(w http.ResponseWriter, req *http.Request, flusher http.Flusher, channel string,
+	sub *subscription, eventCh chan eventOrComment, queue *coalescingQueue, encoding Encoding,
+	opts handlerOptions) *connection {
+	c := &connection{
+		srv:            srv,
+		w:              w,
+		req:            req,
+		flusher:        flusher,
+		channel:        channel,
+		sub:            sub,
+		eventCh:        eventCh,
+		queue:          queue,
+		opts:           opts,
+		encoding:       encoding,
+		writeTimeout:   srv.WriteTimeout,
+		readMainCh:     eventCh,
+		lastReplayedID: sub.lastEventID,
+	}
+	var body io.Writer = w
+	if srv.ByteCounter != nil {
+		body = &byteCountingWriter{w: w, count: func(n int) { srv.ByteCounter(c.channel, n) }}
+	}
+	c.enc = NewEncoderWithEncoding(body, encoding, EncoderOptionGzipLevel(srv.GzipLevel),
+		EncoderOptionLineEnding(srv.LineEnding))
+	if srv.KeepAlive > 0 {
+		c.keepAliveTimer = time.NewTimer(srv.KeepAlive)
+		c.keepAliveCh = c.keepAliveTimer.C
+	}
+	if srv.MaxEventsPerSecond > 0 {
+		c.limiter = newRateLimiter(srv.MaxEventsPerSecond, time.Now())
+	}
+	return c
+}
+
+// Streams events to the client until either side ends the stream, and then reports how it ended.
+func (c *connection) serve() {
+	defer c.enc.release()
+	defer c.stopTimers()
+	defer c.finishCompressedStream()
+
+	ctx := c.req.Context()
+	if c.srv.MaxStreamDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.srv.MaxStreamDuration)
+		defer cancel()
+	}
+	var maxConnTimeCh <-chan time.Time
+	if c.srv.MaxConnTime > 0 {
+		t := time.NewTimer(c.srv.MaxConnTime)
+		defer t.Stop()
+		maxConnTimeCh = t.C
+	}
+
+	if c.srv.DrainTimeout > 0 {
+		handlerDoneCh := make(chan struct{})
+		defer close(handlerDoneCh)
+		go c.interruptDrain(handlerDoneCh)
+	}
+
+	// Initial events are written before anything is read from eventCh, so they precede any replay.
+	if c.writeInitialEvents() {
+		for c.handleNext(ctx.Done(), maxConnTimeCh) {
+		}
+	}
+	c.finish()
+}
+
+// Waits for the next event, timer or disconnection, and handles it. Returns false if the stream must end.
+func (c *connection) handleNext(closeNotify <-chan struct{}, maxConnTimeCh <-chan time.Time) bool {
+	// Checked before each select, rather than with a timer, so that buffered events that are ready to be read
+	// can't keep the handler going after DrainTimeout.
+	if c.drainExpired() {
+		c.endDrain()
+		return false
+	}
+	select {
+	case <-closeNotify:
+		c.reason = DisconnectClientClosed
+		if c.req.Context().Err() == nil { // the client is still there, so it was MaxStreamDuration that expired
+			c.reason = DisconnectMaxStreamDuration
+			c.buffering = false
+			c.writeGenerated(&publication{event: "close"})
+		}
+		return false
+	case <-maxConnTimeCh: // if MaxConnTime was not set, this is a nil channel and has no effect on the select
+		c.reason = DisconnectMaxConnTime
+		return false
+	case <-c.flushTimerCh: // likewise, this is nil unless FlushInterval is set and there is unflushed output
+		c.flushTimerCh = nil
+		c.flush()
+		return true
+	case <-c.heldTimerCh: // likewise, this is nil unless events are being held back by MaxEventsPerSecond
+		return c.writeHeld()
+	case <-c.keepAliveCh: // likewise, this is nil unless KeepAlive is set
+		return c.writeKeepAlive()
+	case ec, ok := <-c.readMainCh:
+		return c.handleLive(ec, ok)
+	case ev, ok := <-c.readBatchCh:
+		return c.handleReplayed(ev, ok)
+	}
+}
+
+// Writes the padding, retry directive and initial events, if any. Returns false if a write failed.
+func (c *connection) writeInitialEvents() bool {
+	srv := c.srv
+	if srv.SendInitialPadding && !c.writeEventOrComment(comment{value: initialPadding(srv.InitialPaddingSize)}) {
+		return false
+	}
+	if srv.RetryBase > 0 || srv.RetryJitter > 0 {
+		delay := srv.RetryBase
+		if srv.RetryJitter > 0 {
+			delay += randomRetryJitter(srv.RetryJitter)
+		}
+		if !c.writeEventOrComment(retryDirective(delay)) {
+			return false
+		}
+	}
+	if c.opts.initial == nil {
+		return true
+	}
+	events, err := c.opts.initial()
+	if err != nil && srv.Logger != nil {
+		srv.Logger.Println("eventsource: error getting initial events:", err)
+	}
+	for _, ev := range events {
+		if !c.writeEventOrComment(ev) {
+			return false
+		}
+	}
+	return true
+}
+
+// Handles an event or comment from eventCh, or the end of the subscription if eventCh was closed. Returns
+// false if the stream must end.
+func (c *connection) handleLive(ec eventOrComment, ok bool) bool {
+	if !ok {
+		c.closedNormally = true
+		c.reason = c.sub.closeReason // safe to read, since the Server set it before closing the channel
+		return false
+	}
+	if switched, ok := ec.(channelSwitched); ok {
+		c.channel = switched.channel
+		return true
+	}
+	if batch, ok := ec.(eventBatch); ok {
+		c.readBatchCh = batch.events
+		c.replay = batch.result
+		c.readMainCh = nil
+		c.buffering = c.srv.BufferReplay
+		return true
+	}
+	if live, ok := ec.(Event); ok && c.limiter != nil && (len(c.held) > 0 || !c.limiter.allow(time.Now())) {
+		// Once events are being held back, later ones must wait behind them to keep them in order
+		if c.srv.CoalesceRateLimited {
+			c.held = holdEvent(c.held, live)
+			if c.heldTimerCh == nil {
+				c.startHeldTimer(c.limiter.wait(time.Now()))
+			}
+		}
+		return true
+	}
+	if urgent, ok := ec.(flushNow); ok {
+		return c.writeNow(urgent.value)
+	}
+	return c.writeEventOrComment(ec)
+}
+
+// Handles an event from a replay, or the end of the replay if its channel was closed. Returns false if the
+// stream must end.
+func (c *connection) handleReplayed(ev Event, ok bool) bool {
+	if !ok {
+		return c.endReplay()
+	}
+	if ev.Id() != "" {
+		c.lastReplayedID = ev.Id()
+	}
+	return !c.sub.accepts(ev) || c.writeEventOrComment(ev)
+}
+
+// Switches back to reading from eventCh at the end of a replay, flushing the replayed events if they were
+// buffered, and tells the client that the replay is over if it asked for that. Returns false if a write
+// failed.
+func (c *connection) endReplay() bool {
+	c.readBatchCh = nil
+	c.readMainCh = c.eventCh
+	if c.replay.panicked {
+		c.reason = DisconnectPanic
+		return false
+	}
+	if c.buffering {
+		c.buffering = false
+		c.extendWriteDeadline()
+		if err := c.enc.flush(); err != nil {
+			c.reason = DisconnectWriteError
+			if c.srv.Logger != nil {
+				c.srv.Logger.Println(err)
+			}
+			return false
+		}
+		c.flusher.Flush()
+	}
+	if c.replay.incomplete && !c.writeGenerated(&publication{event: "_replay_incomplete", data: c.sub.lastEventID}) {
+		return false
+	}
+	if c.srv.SendCaughtUp && !c.writeGenerated(&publication{event: "_caught_up", data: c.lastReplayedID}) {
+		return false
+	}
+	if c.srv.ReplayDoneEvent != "" &&
+		!c.writeGenerated(&publication{event: c.srv.ReplayDoneEvent, data: c.lastReplayedID}) {
+		return false
+	}
+	return true
+}
+
+// Writes the events that MaxEventsPerSecond held back, as far as the rate limiter allows, and restarts
+// heldTimer if some are still waiting. Returns false if a write failed.
+func (c *connection) writeHeld() bool {
+	c.heldTimerCh = nil
+	now := time.Now()
+	for len(c.held) > 0 && c.limiter.allow(now) {
+		next := c.held[0]
+		c.held = c.held[1:]
+		if !c.writeEventOrComment(next) {
+			return false
+		}
+	}
+	if len(c.held) > 0 {
+		c.startHeldTimer(c.limiter.wait(now))
+	}
+	return true
+}
+
+func (c *connection) startHeldTimer(d time.Duration) {
+	if c.heldTimer == nil {
+		c.heldTimer = time.NewTimer(d)
+	} else {
+		c.heldTimer.Reset(d)
+	}
+	c.heldTimerCh = c.heldTimer.C
+}
+
+// Writes a keep-alive comment, or HeartbeatEvent. Returns false if the write failed.
+func (c *connection) writeKeepAlive() bool {
+	var keepAlive eventOrComment = comment{}
+	if c.srv.HeartbeatEvent != "" {
+		// Some clients only reset their read timeouts when they receive an event, not a comment
+		keepAlive = &publication{event: c.srv.HeartbeatEvent}
+	}
+	return c.writeGenerated(keepAlive)
+}
+
+// Writes an event for PublishNow, and flushes it along with anything that was waiting for flushTimer.
+// Returns false if the write failed.
+func (c *connection) writeNow(ec eventOrComment) bool {
+	if !c.writeEventOrComment(ec) {
+		return false
+	}
+	if c.flushTimerCh != nil { // otherwise, writeEventOrComment has already flushed
+		if !c.flushTimer.Stop() {
+			<-c.flushTimer.C
+		}
+		c.flushTimerCh = nil
+		c.flush()
+	}
+	return true
+}
+
+// Writes an event that the Server generated itself, rather than one that was published, like
+// writeEventOrComment. If the write fails, the event is not reported to OnUndelivered.
+func (c *connection) writeGenerated(ec eventOrComment) bool {
+	if !c.writeEventOrComment(ec) {
+		c.failedEventOrComment = nil
+		return false
+	}
+	return true
+}
+
+// Writes an event or comment, and flushes it unless FlushInterval or BufferReplay delays that. Returns false
+// if the write failed; if this happens, we'll end the handler early because something's clearly broken.
+func (c *connection) writeEventOrComment(ec eventOrComment) bool {
+	c.extendWriteDeadline()
+	encode := c.enc.Encode
+	if c.buffering {
+		encode = c.enc.encode
+	}
+	if err := encode(ec); err != nil {
+		c.failedEventOrComment = ec
+		c.reason = DisconnectWriteError
+		if c.srv.Logger != nil {
+			c.srv.Logger.Println(err)
+		}
+		return false
+	}
+	if c.keepAliveTimer != nil {
+		if !c.keepAliveTimer.Stop() {
+			select {
+			case <-c.keepAliveTimer.C:
+			default:
+			}
+		}
+		c.keepAliveTimer.Reset(c.srv.KeepAlive)
+	}
+	if c.buffering {
+		return true
+	}
+	if c.srv.FlushInterval <= 0 {
+		c.flusher.Flush()
+	} else if c.flushTimerCh == nil {
+		if c.flushTimer == nil {
+			c.flushTimer = time.NewTimer(c.srv.FlushInterval)
+		} else {
+			c.flushTimer.Reset(c.srv.FlushInterval)
+		}
+		c.flushTimerCh = c.flushTimer.C
+	}
+	return true
+}
+
+func (c *connection) flush() {
+	c.extendWriteDeadline()
+	c.flusher.Flush()
+}
+
+func (c *connection) extendWriteDeadline() {
+	var deadline time.Time
+	if c.writeTimeout > 0 {
+		deadline = time.Now().Add(c.writeTimeout)
+	}
+	if drainDeadline, ok := c.drainDeadline(); ok && (deadline.IsZero() || drainDeadline.Before(deadline)) {
+		deadline = drainDeadline
+	}
+	if !deadline.IsZero() {
+		c.setWriteDeadline(deadline)
+	}
+}
+
+func (c *connection) setWriteDeadline(deadline time.Time) {
+	if c.noWriteDeadlines {
+		return
+	}
+	if err := setWriteDeadline(c.w, deadline); err != nil {
+		if c.srv.Logger != nil {
+			c.srv.Logger.Println("eventsource: cannot set write deadline:", err)
+		}
+		c.noWriteDeadlines = true
+	}
+}
+
+// Runs while the handler is streaming if DrainTimeout is set. If the Server closes the subscription, this
+// sets the write deadline to when DrainTimeout elapses, so that a write that is blocked because the client
+// has stopped reading fails then, rather than keeping the handler going indefinitely. If that isn't
+// supported, the handler logs it the next time it sets the deadline itself.
+func (c *connection) interruptDrain(handlerDoneCh <-chan struct{}) {
+	select {
+	case <-c.sub.closedCh:
+		if drainDeadline, ok := c.drainDeadline(); ok {
+			_ = setWriteDeadline(c.w, drainDeadline)
+		}
+	case <-handlerDoneCh:
+	}
+}
+
+// Returns the time when DrainTimeout elapses, and true, if the Server has closed the subscription.
+func (c *connection) drainDeadline() (time.Time, bool) {
+	if c.srv.DrainTimeout <= 0 {
+		return time.Time{}, false
+	}
+	select {
+	case <-c.sub.closedCh:
+		return c.sub.closedAt.Add(c.srv.DrainTimeout), true // safe to read, since closedCh is closed
+	default:
+		return time.Time{}, false
+	}
+}
+
+// Returns true if the Server closed the subscription more than DrainTimeout ago.
+func (c *connection) drainExpired() bool {
+	drainDeadline, ok := c.drainDeadline()
+	return ok && !time.Now().Before(drainDeadline)
+}
+
+// Records that the stream ended because DrainTimeout elapsed.
+func (c *connection) endDrain() {
+	c.closedNormally = true // the Server has already removed the subscription
+	c.drainTimedOut = true
+	c.reason = c.sub.closeReason
+}
+
+// Tells the Server that the stream has ended, unless the Server ended it, and reports why it ended.
+func (c *connection) finish() {
+	srv := c.srv
+	if !c.closedNormally && c.drainExpired() {
+		c.endDrain() // a write failed because it was still blocked when DrainTimeout elapsed
+	}
+	if c.readBatchCh != nil {
+		// The replay was interrupted. A RepositoryWithContext will stop when cancelReplay is called, but any
+		// other Repository will keep writing to the channel, so it must still be read to the end.
+		go func(ch <-chan Event) {
+			for range ch {
+			}
+		}(c.readBatchCh)
+	}
+	if !c.closedNormally {
+		// The server didn't tell us to close, so we must tell it that we're closing, unless it has already
+		// shut down: run() never sends to unsubs itself, so it can't be blocked waiting for this handler.
+		select {
+		case srv.unsubs <- c.sub:
+		case <-srv.done:
+		}
+	}
+	if (!c.closedNormally || c.drainTimedOut) && srv.OnUndelivered != nil {
+		c.reportUndelivered()
+	}
+	if srv.OnDisconnect != nil {
+		srv.OnDisconnect(c.channel, c.reason)
+	}
+}
+
+// Passes the event that could not be written, if any, and any events still buffered for a subscription
+// that is ending, to OnUndelivered. If Coalesce is set, the events that are still in the subscription's
+// coalescingQueue are passed too.
+func (c *connection) reportUndelivered() {
+	if ev, ok := c.failedEventOrComment.(Event); ok {
+		c.srv.OnUndelivered(c.channel, ev)
+	}
+	if c.queue != nil {
+		// The pump goroutine may be sending an event to eventCh, which it closes once it has stopped.
+		c.queue.stop()
+		for ec := range c.eventCh {
+			c.reportUndeliveredItem(ec)
+		}
+		for _, ec := range c.queue.drain() {
+			c.reportUndeliveredItem(ec)
+		}
+		return
+	}
+	for {
+		select {
+		case ec, ok := <-c.eventCh:
+			if !ok {
+				return
+			}
+			c.reportUndeliveredItem(ec)
+		default:
+			return
+		}
+	}
+}
+
+func (c *connection) reportUndeliveredItem(ec eventOrComment) {
+	if switched, ok := ec.(channelSwitched); ok {
+		c.channel = switched.channel // so that the events after it, and OnDisconnect, have the new channel
+		return
+	}
+	if urgent, ok := ec.(flushNow); ok {
+		ec = urgent.value
+	}
+	if ev, ok := ec.(Event); ok {
+		c.srv.OnUndelivered(c.channel, ev)
+	}
+}
+
+// If the client is still connected when the stream ends, a compressed stream is finished properly, so that
+// the client can tell that it wasn't truncated. This must run before the Encoder is released.
+func (c *connection) finishCompressedStream() {
+	if c.encoding == EncodingNone || c.reason == DisconnectWriteError || c.drainTimedOut || c.req.Context().Err() != nil {
+		return
+	}
+	c.extendWriteDeadline()
+	if err := c.enc.close(); err != nil {
+		if c.srv.Logger != nil {
+			c.srv.Logger.Println(err)
+		}
+		return
+	}
+	c.flusher.Flush()
+}
+
+func (c *connection) stopTimers() {
+	if c.heldTimer != nil {
+		c.heldTimer.Stop()
+	}
+	if c.keepAliveTimer != nil {
+		c.keepAliveTimer.Stop()
+	}
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+	}
+	if c.writeTimeout > 0 || c.srv.DrainTimeout > 0 {
+		_ = setWriteDeadline(c.w, time.Time{})
+	}
+}
@@ -2,6 +2,7 @@ package eventsource
 
 import (
 	"bufio"
+	"encoding/base64"
 	"io"
 	"strconv"
 	"strings"
@@ -22,6 +23,12 @@ func (s *publication) Retry() int64  { return s.retry }
 // LastEventID is from a separate interface, EventWithLastID
 func (s *publication) LastEventID() string { return s.lastEventID }
 
+// DecodeBinaryEvent returns the bytes carried by an event that was created with NewBinaryEvent, by decoding
+// its data as standard base64. It returns an error if the data is not valid base64.
+func DecodeBinaryEvent(ev Event) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(ev.Data())
+}
+
 // A Decoder is capable of reading Events from a stream.
 type Decoder struct {
 	linesCh     <-chan string
@@ -82,6 +89,29 @@ func NewDecoderWithOptions(r io.Reader, options ...DecoderOption) *Decoder {
 	return d
 }
 
+// ReadEvents decodes the next n events from r, skipping comments, such as keep-alives, and retry fields
+// that are not part of an event. It is meant for tests that make requests to a Server, for instance with
+// net/http/httptest. If the stream ends or fails first, it returns the events that it did read along with
+// the error, which is io.EOF if the stream ended between events.
+//
+// Since the Decoder may read ahead, r should not be used for anything else afterward; to read more
+// events later, create a Decoder instead.
+func ReadEvents(r io.Reader, n int) ([]Event, error) {
+	dec := NewDecoder(r)
+	events := make([]Event, 0, n)
+	for len(events) < n {
+		ev, err := dec.Decode()
+		if err != nil {
+			return events, err
+		}
+		if pub := ev.(*publication); pub.id == "" && pub.event == "" && pub.data == "" {
+			continue // this only set the retry delay
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
 // Decode reads the next Event from a stream (and will block until one
 // comes in).
 // Graceful disconnects (between events) are indicated by an io.EOF error.
@@ -1,6 +1,8 @@
 package eventsource
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"strings"
 	"testing"
@@ -50,6 +52,43 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+func TestDecoderMultiLineData(t *testing.T) {
+	// These are the inverse of the TestEncoderMultiLineData cases
+	for _, tc := range []encoderTestCase{
+		{publication{data: "\nfirst"}, "data: \ndata: first\n\n"},
+		{publication{data: "first\nsecond"}, "data: first\ndata: second\n\n"},
+		{publication{data: "first\nsecond\nthird"}, "data: first\ndata: second\ndata: third\n\n"},
+		{publication{data: "ends with newline\n"}, "data: ends with newline\ndata: \n\n"},
+		{publication{data: "first\nends with newline\n"}, "data: first\ndata: ends with newline\ndata: \n\n"},
+	} {
+		t.Run(fmt.Sprintf("%q", tc.expected), func(t *testing.T) {
+			event, err := NewDecoder(strings.NewReader(tc.expected)).Decode()
+			require.NoError(t, err)
+			assert.Equal(t, tc.event.data, event.Data())
+
+			buf := bytes.NewBuffer(nil)
+			require.NoError(t, NewEncoder(buf, false).Encode(event))
+			assert.Equal(t, tc.expected, buf.String())
+		})
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	input := ":ok\nretry: 1000\n\nevent: a\ndata: 1\n\n:\n:keep-alive\n\nid: x\ndata: 2\n\ndata: 3\n\n"
+
+	events, err := ReadEvents(strings.NewReader(input), 2)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, "a", events[0].Event())
+	assert.Equal(t, "1", events[0].Data())
+	assert.Equal(t, "x", events[1].Id())
+	assert.Equal(t, "2", events[1].Data())
+
+	events, err = ReadEvents(strings.NewReader(input), 4)
+	assert.Equal(t, io.EOF, err)
+	assert.Len(t, events, 3)
+}
+
 func requireLastEventID(t *testing.T, event Event) string {
 	// necessary because we can't yet add LastEventID to the basic Event interface; see EventWithLastID
 	eventWithID, ok := event.(EventWithLastID)
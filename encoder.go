@@ -1,10 +1,19 @@
 package eventsource
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
 )
 
 var (
@@ -17,60 +26,369 @@ var (
 		{"event: ", Event.Event, false},
 		{"data: ", Event.Data, true},
 	}
+
+	// gzip writers allocate large internal buffers, so the Server reuses them across connections. A writer's
+	// compression level can't be changed, so there is a pool for each level, indexed by level-gzip.HuffmanOnly.
+	gzipWriterPools = newGzipWriterPools() //nolint:gochecknoglobals // non-exported global that we treat as a constant
+
+	brotliWriterPool = sync.Pool{ //nolint:gochecknoglobals // non-exported global that we treat as a constant
+		New: func() interface{} { return brotli.NewWriter(ioutil.Discard) },
+	}
+
+	// An Encoder collects each event's fields in a buffer, so that they reach the underlying writer, and the
+	// network, in one write rather than several.
+	bufferedWriterPool = sync.Pool{ //nolint:gochecknoglobals // non-exported global that we treat as a constant
+		New: func() interface{} { return bufio.NewWriterSize(ioutil.Discard, encoderBufferSize) },
+	}
 )
 
+const encoderBufferSize = 4096
+
+// Encoding is a content coding that an Encoder can apply to its output.
+type Encoding int
+
+const (
+	// EncodingNone means that the output is not compressed.
+	EncodingNone Encoding = iota
+	// EncodingGzip means that the output is compressed with gzip.
+	EncodingGzip
+	// EncodingBrotli means that the output is compressed with brotli.
+	EncodingBrotli
+)
+
+// ContentEncoding returns the value of the Content-Encoding header for the encoding, or "" for EncodingNone.
+func (e Encoding) ContentEncoding() string {
+	switch e {
+	case EncodingGzip:
+		return "gzip"
+	case EncodingBrotli:
+		return "br"
+	default:
+		return ""
+	}
+}
+
+func newGzipWriterPools() []*sync.Pool {
+	pools := make([]*sync.Pool, gzip.BestCompression-gzip.HuffmanOnly+1)
+	for i := range pools {
+		level := i + gzip.HuffmanOnly
+		pools[i] = &sync.Pool{New: func() interface{} {
+			gz, _ := gzip.NewWriterLevel(ioutil.Discard, level) // can't fail, since the level is valid
+			return gz
+		}}
+	}
+	return pools
+}
+
 // An Encoder is capable of writing Events to a stream. Optionally
-// Events can be gzip compressed in this process.
+// Events can be gzip or brotli compressed in this process.
 type Encoder struct {
-	w          io.Writer
-	compressed bool
+	w          io.Writer     // the compressing writer, if any, or else the writer that the Encoder was created for
+	buf        *bufio.Writer // writes to w
+	encoding   Encoding
+	gzipLevel  int
+	lineEnding string
+}
+
+// EncoderOption is a common interface for optional configuration parameters that can be
+// used in creating an Encoder.
+type EncoderOption interface {
+	apply(e *Encoder)
+}
+
+type gzipLevelEncoderOption int
+
+func (o gzipLevelEncoderOption) apply(e *Encoder) {
+	if int(o) < gzip.HuffmanOnly || int(o) > gzip.BestCompression {
+		e.gzipLevel = gzip.DefaultCompression
+		return
+	}
+	e.gzipLevel = int(o)
+}
+
+// EncoderOptionGzipLevel returns an option that sets the compression level, such as gzip.BestSpeed or
+// gzip.BestCompression, for an Encoder that is created with gzip compression. An invalid level is replaced
+// with gzip.DefaultCompression, which is also the default.
+func EncoderOptionGzipLevel(level int) EncoderOption {
+	return gzipLevelEncoderOption(level)
+}
+
+type lineEndingEncoderOption string
+
+func (o lineEndingEncoderOption) apply(e *Encoder) {
+	if o == "\r\n" {
+		e.lineEnding = "\r\n"
+		return
+	}
+	e.lineEnding = "\n"
+}
+
+// EncoderOptionLineEnding returns an option that sets the line terminator that an Encoder writes, for clients
+// that only parse text/event-stream with CRLF line endings. It must be "\n", which is the default, or
+// "\r\n"; any other value is replaced with "\n". Data and comments containing "\n" are still split into
+// several lines, each ending with the terminator.
+func EncoderOptionLineEnding(ending string) EncoderOption {
+	return lineEndingEncoderOption(ending)
 }
 
 // NewEncoder returns an Encoder for a given io.Writer.
 // When compressed is set to true, a gzip writer will be
 // created.
 func NewEncoder(w io.Writer, compressed bool) *Encoder {
+	return NewEncoderWithOptions(w, compressed)
+}
+
+// NewEncoderWithOptions is the same as NewEncoder, with optional configuration parameters.
+func NewEncoderWithOptions(w io.Writer, compressed bool, options ...EncoderOption) *Encoder {
+	encoding := EncodingNone
 	if compressed {
-		return &Encoder{w: gzip.NewWriter(w), compressed: true}
+		encoding = EncodingGzip
+	}
+	return NewEncoderWithEncoding(w, encoding, options...)
+}
+
+// NewEncoderWithEncoding returns an Encoder for a given io.Writer that compresses its output with the
+// specified Encoding, with optional configuration parameters.
+func NewEncoderWithEncoding(w io.Writer, encoding Encoding, options ...EncoderOption) *Encoder {
+	enc := &Encoder{w: w, gzipLevel: gzip.DefaultCompression, lineEnding: "\n"}
+	for _, o := range options {
+		o.apply(enc)
+	}
+	switch encoding {
+	case EncodingGzip:
+		gz := gzipWriterPools[enc.gzipLevel-gzip.HuffmanOnly].Get().(*gzip.Writer)
+		gz.Reset(w)
+		enc.w, enc.encoding = gz, encoding
+	case EncodingBrotli:
+		br := brotliWriterPool.Get().(*brotli.Writer)
+		br.Reset(w)
+		enc.w, enc.encoding = br, encoding
+	}
+	enc.buf = bufferedWriterPool.Get().(*bufio.Writer)
+	enc.buf.Reset(enc.w)
+	return enc
+}
+
+// release returns the Encoder's buffer, and its compressing writer, if any, to their pools; the Encoder must
+// not be used afterward.
+//
+// The writer is reset rather than closed: if the client has disconnected, closing would only try to write
+// the compressed stream's trailer to a dead connection, whereas resetting discards any partially written
+// state and any error from the old connection so the writer is safe to reuse.
+func (enc *Encoder) release() {
+	enc.buf.Reset(ioutil.Discard)
+	bufferedWriterPool.Put(enc.buf)
+	enc.buf = nil
+	switch enc.encoding {
+	case EncodingGzip:
+		gz := enc.w.(*gzip.Writer)
+		gz.Reset(ioutil.Discard)
+		gzipWriterPools[enc.gzipLevel-gzip.HuffmanOnly].Put(gz)
+		enc.w = nil
+	case EncodingBrotli:
+		br := enc.w.(*brotli.Writer)
+		br.Reset(ioutil.Discard)
+		brotliWriterPool.Put(br)
+		enc.w = nil
 	}
-	return &Encoder{w: w}
 }
 
 // Encode writes an event or comment in the format specified by the
 // server-sent events protocol.
 func (enc *Encoder) Encode(ec eventOrComment) error {
+	if err := enc.encode(ec); err != nil {
+		return err
+	}
+	return enc.flush()
+}
+
+// encode is the same as Encode, except that output may stay in the Encoder's buffer, and compressed output in
+// the compressing writer's buffer, until flush is called. Writing several events before flushing compresses
+// them much better.
+func (enc *Encoder) encode(ec eventOrComment) error {
 	switch item := ec.(type) {
-	case Event:
-		for _, field := range encFields {
-			prefix, value := field.prefix, field.value(item)
-			if len(value) == 0 && !field.required {
-				continue
-			}
-			for _, s := range strings.Split(value, "\n") {
-				if _, err := io.WriteString(enc.w, prefix); err != nil {
-					return fmt.Errorf("eventsource encode: %v", err)
-				}
-				if _, err := io.WriteString(enc.w, s); err != nil {
-					return fmt.Errorf("eventsource encode: %v", err)
-				}
-				if _, err := io.WriteString(enc.w, "\n"); err != nil {
-					return fmt.Errorf("eventsource encode: %v", err)
-				}
-			}
+	case EventWithEncoding:
+		if ev, ok := item.(Event); ok && enc.lineEnding != "\n" {
+			return enc.encodeEvent(ev) // the bytes were encoded with the default line ending
 		}
-		if _, err := io.WriteString(enc.w, "\n"); err != nil {
+		if _, err := enc.buf.Write(item.Encoded()); err != nil {
 			return fmt.Errorf("eventsource encode: %v", err)
 		}
+	case Event:
+		return enc.encodeEvent(item)
 	case comment:
-		line := ":" + item.value + "\n"
-		if _, err := io.WriteString(enc.w, line); err != nil {
+		if err := enc.writeComment(item.value); err != nil {
+			return err
+		}
+	case retryDirective:
+		retry := fmt.Sprintf("retry: %d%s%s", time.Duration(item).Milliseconds(), enc.lineEnding, enc.lineEnding)
+		if _, err := enc.buf.WriteString(retry); err != nil {
 			return fmt.Errorf("eventsource encode: %v", err)
 		}
 	default:
 		return fmt.Errorf("unexpected parameter to Encode: %v", ec)
 	}
-	if enc.compressed {
-		return enc.w.(*gzip.Writer).Flush()
+	return nil
+}
+
+// Writes an event's comments, if it has any, and its fields.
+func (enc *Encoder) encodeEvent(ev Event) error {
+	if withComments, ok := ev.(EventWithComments); ok {
+		for _, c := range withComments.Comments() {
+			if err := enc.writeComment(c); err != nil {
+				return err
+			}
+		}
+	}
+	for _, field := range encFields {
+		prefix, value := field.prefix, field.value(ev)
+		if len(value) == 0 && !field.required && !(prefix == "id: " && resetsID(ev)) {
+			continue
+		}
+		for _, s := range strings.Split(value, "\n") {
+			if _, err := enc.buf.WriteString(prefix); err != nil {
+				return fmt.Errorf("eventsource encode: %v", err)
+			}
+			if _, err := enc.buf.WriteString(s); err != nil {
+				return fmt.Errorf("eventsource encode: %v", err)
+			}
+			if _, err := enc.buf.WriteString(enc.lineEnding); err != nil {
+				return fmt.Errorf("eventsource encode: %v", err)
+			}
+		}
+	}
+	if _, err := enc.buf.WriteString(enc.lineEnding); err != nil {
+		return fmt.Errorf("eventsource encode: %v", err)
+	}
+	return nil
+}
+
+// resetsID returns true if ev is an EventWithIDReset that must be written with an empty "id:" field.
+func resetsID(ev Event) bool {
+	r, ok := ev.(EventWithIDReset)
+	return ok && r.ResetID() && ev.Id() == ""
+}
+
+// NewJSONEvent returns an Event with the specified ID and event type, whose data is v marshaled as JSON.
+// Either ID or event type may be empty. The JSON is compact, even if v implements json.Marshaler with
+// indented output, so it is sent as a single data line; newlines within strings are escaped as \n. It
+// returns an error if v can't be marshaled.
+func NewJSONEvent(id, event string, v interface{}) (Event, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &publication{id: id, event: event, data: string(data)}, nil
+}
+
+// NewBinaryEvent returns an Event with the specified ID and event type, whose data is b encoded as standard
+// base64 (RFC 4648, with padding). The text/event-stream format can only carry text, so this is a way to
+// send occasional small binary payloads over the same stream; base64 makes the data a third larger. Either
+// ID or event type may be empty. A client using this package can get the bytes back with DecodeBinaryEvent.
+func NewBinaryEvent(id, event string, b []byte) Event {
+	return &publication{id: id, event: event, data: base64.StdEncoding.EncodeToString(b)}
+}
+
+// ErrorEvent is an Event that tells clients that something went wrong on the server, such as a failure of the
+// source of a channel's events. Its event type is "error", and its data is a JSON object with "code" and
+// "message" properties, so clients can handle all such errors in the same way. It has no ID.
+//
+// A browser's EventSource also dispatches connection failures to "error" listeners, as plain Event objects
+// without data, so a listener for ErrorEvents should check that the event has data.
+type ErrorEvent struct {
+	Code    int
+	Message string
+}
+
+// Id returns "", since an ErrorEvent has no ID.
+func (e *ErrorEvent) Id() string { return "" } //nolint:golint,stylecheck // must match the Event interface
+
+// Event returns "error".
+func (e *ErrorEvent) Event() string { return "error" }
+
+// Data returns the JSON object containing the code and message.
+func (e *ErrorEvent) Data() string {
+	data, _ := json.Marshal(struct { // can't fail, since the fields are an int and a string
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}{e.Code, e.Message})
+	return string(data)
+}
+
+// PreEncode returns an Event that has the same fields as ev, and that also implements EventWithEncoding
+// by returning ev's encoded form, including any comments from EventWithComments. Publishing the returned
+// event to many subscribers saves each of them from encoding it again. The encoded form uses the default
+// "\n" line ending, so an Encoder whose LineEnding is "\r\n" encodes the event's fields and comments instead.
+func PreEncode(ev Event) Event {
+	return &preEncodedEvent{wrapped: ev, encoded: EncodeEvent(ev)}
+}
+
+// EncodeEvent returns the uncompressed text/event-stream encoding of an event, exactly as an Encoder would
+// write it, including the blank line that ends it. This is useful for logging events, or for comparing them
+// with expected output in tests.
+func EncodeEvent(ev Event) []byte {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf, false)
+	defer enc.release()
+	_ = enc.Encode(ev) // can't fail, since writing to a bytes.Buffer can't fail
+	return buf.Bytes()
+}
+
+type preEncodedEvent struct {
+	wrapped Event
+	encoded []byte
+}
+
+//nolint:golint,stylecheck // must match the Event interface
+func (e *preEncodedEvent) Id() string      { return e.wrapped.Id() }
+func (e *preEncodedEvent) Event() string   { return e.wrapped.Event() }
+func (e *preEncodedEvent) Data() string    { return e.wrapped.Data() }
+func (e *preEncodedEvent) Encoded() []byte { return e.encoded }
+
+// Comments returns the wrapped event's comments, so that an Encoder that can't use the encoded form still
+// writes them.
+func (e *preEncodedEvent) Comments() []string {
+	if withComments, ok := e.wrapped.(EventWithComments); ok {
+		return withComments.Comments()
+	}
+	return nil
+}
+
+// ResetID returns true if the wrapped event resets the client's ID.
+func (e *preEncodedEvent) ResetID() bool { return resetsID(e.wrapped) }
+
+// flush writes any output that is buffered in the Encoder, and any compressed output that is buffered in the
+// compressing writer.
+func (enc *Encoder) flush() error {
+	if err := enc.buf.Flush(); err != nil {
+		return fmt.Errorf("eventsource encode: %v", err)
+	}
+	if enc.encoding != EncodingNone {
+		return enc.w.(interface{ Flush() error }).Flush()
+	}
+	return nil
+}
+
+// close writes any buffered output, and then ends the compressed stream, if the output is compressed, by
+// writing its trailer. The Encoder must not be used afterward, except to release it.
+func (enc *Encoder) close() error {
+	if err := enc.buf.Flush(); err != nil {
+		return fmt.Errorf("eventsource encode: %v", err)
+	}
+	if enc.encoding != EncodingNone {
+		if err := enc.w.(io.Closer).Close(); err != nil {
+			return fmt.Errorf("eventsource encode: %v", err)
+		}
+	}
+	return nil
+}
+
+func (enc *Encoder) writeComment(text string) error {
+	// A comment can't span lines, so text containing newlines is written as several comments.
+	for _, s := range strings.Split(text, "\n") {
+		if _, err := enc.buf.WriteString(":" + s + enc.lineEnding); err != nil {
+			return fmt.Errorf("eventsource encode: %v", err)
+		}
 	}
 	return nil
 }
@@ -4,11 +4,18 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type encoderTestCase struct {
@@ -58,6 +65,21 @@ func TestEncoderMultiLineData(t *testing.T) {
 	}
 }
 
+func TestEncoderWritesEachEventInOneWrite(t *testing.T) {
+	w := &writeCountingWriter{}
+	enc := NewEncoder(w, false)
+	require.NoError(t, enc.Encode(&publication{id: "aaa", event: "bbb", data: "ccc\nddd"}))
+	require.NoError(t, enc.Encode(comment{value: "hello"}))
+	assert.Equal(t, 2, w.writes)
+
+	// Without Encode's flush, events stay in the buffer
+	require.NoError(t, enc.encode(&publication{data: "eee"}))
+	require.NoError(t, enc.encode(&publication{data: "fff"}))
+	assert.Equal(t, 2, w.writes)
+	require.NoError(t, enc.flush())
+	assert.Equal(t, 3, w.writes)
+}
+
 func TestEncoderComment(t *testing.T) {
 	buf := bytes.NewBuffer(nil)
 	c := comment{value: "hello"}
@@ -82,6 +104,49 @@ func TestEncoderGzipCompression(t *testing.T) {
 	assert.Equal(t, expectedCompressedBuf.Bytes(), compressedBuf.Bytes())
 }
 
+func TestEncoderGzipLevel(t *testing.T) {
+	event := &publication{event: "aaa", data: "bbb"}
+	for _, level := range []int{gzip.BestSpeed, gzip.BestCompression, gzip.HuffmanOnly} {
+		t.Run(fmt.Sprintf("level %d", level), func(t *testing.T) {
+			uncompressedBuf, compressedBuf := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+			expectedCompressedBuf := bytes.NewBuffer(nil)
+			NewEncoder(uncompressedBuf, false).Encode(event)
+			zipper, err := gzip.NewWriterLevel(expectedCompressedBuf, level)
+			require.NoError(t, err)
+			zipper.Write(uncompressedBuf.Bytes())
+			zipper.Flush()
+
+			enc := NewEncoderWithOptions(compressedBuf, true, EncoderOptionGzipLevel(level))
+			require.NoError(t, enc.Encode(event))
+			enc.release()
+			assert.Equal(t, expectedCompressedBuf.Bytes(), compressedBuf.Bytes())
+		})
+	}
+
+	t.Run("invalid level", func(t *testing.T) {
+		enc := NewEncoderWithOptions(bytes.NewBuffer(nil), true, EncoderOptionGzipLevel(42))
+		defer enc.release()
+		assert.Equal(t, gzip.DefaultCompression, enc.gzipLevel)
+	})
+}
+
+func TestEncoderBrotliCompression(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	enc := NewEncoderWithEncoding(buf, EncodingBrotli)
+	require.NoError(t, enc.Encode(&publication{event: "aaa", data: "bbb"}))
+	enc.release()
+
+	decompressed, err := ioutil.ReadAll(brotli.NewReader(buf))
+	require.NoError(t, err)
+	assert.Equal(t, "event: aaa\ndata: bbb\n\n", string(decompressed))
+}
+
+func TestEncoderRetryDirective(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, NewEncoder(buf, false).Encode(retryDirective(1500*time.Millisecond)))
+	assert.Equal(t, "retry: 1500\n\n", buf.String())
+}
+
 func TestEncoderCanWriteToWriterWithOrWithoutWriteStringMethod(t *testing.T) {
 	// We're using bufio.WriteString, so that we should get consistent output regardless of whether
 	// the underlying Writer supports the WriteString method (as the standard http.ResponseWriter
@@ -109,3 +174,214 @@ func TestEncoderCanWriteToWriterWithOrWithoutWriteStringMethod(t *testing.T) {
 	t.Run("with WriteString", func(t *testing.T) { doTest(t, true) })
 	t.Run("without WriteString", func(t *testing.T) { doTest(t, false) })
 }
+
+type failingWriter struct{}
+
+func (w failingWriter) Write([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+// shortWriter accepts up to limit bytes, and then fails.
+type shortWriter struct {
+	limit   int
+	written []byte
+	calls   int
+}
+
+func (w *shortWriter) Write(data []byte) (int, error) {
+	w.calls++
+	if len(w.written)+len(data) > w.limit {
+		n := w.limit - len(w.written)
+		w.written = append(w.written, data[:n]...)
+		return n, errors.New("connection reset")
+	}
+	w.written = append(w.written, data...)
+	return len(data), nil
+}
+
+func TestEncoderStopsAtFirstWriteError(t *testing.T) {
+	line := strings.Repeat("x", encoderBufferSize)
+	ev := &publication{id: "aaa", data: line + "\n" + line + "\n" + line}
+	w := &shortWriter{limit: encoderBufferSize + 100}
+	enc := NewEncoder(w, false)
+
+	err := enc.Encode(ev)
+	assert.EqualError(t, err, "eventsource encode: connection reset")
+	assert.Equal(t, string(EncodeEvent(ev)[:w.limit]), string(w.written))
+	calls := w.calls
+
+	// Nothing else is written, either for the rest of the event or for later ones
+	assert.Error(t, enc.Encode(&publication{data: "bbb"}))
+	assert.Equal(t, calls, w.calls)
+}
+
+func TestEncoderGzipWriterIsResetWhenReleasedAfterError(t *testing.T) {
+	enc := NewEncoder(failingWriter{}, true)
+	assert.Error(t, enc.Encode(&publication{data: "aaa"}))
+	gz := enc.w.(*gzip.Writer)
+	enc.release()
+
+	// The released writer must not retain the error or any partial output from the failed connection.
+	buf := bytes.NewBuffer(nil)
+	gz.Reset(buf)
+	_, err := gz.Write([]byte("data: bbb\n\n"))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	r, err := gzip.NewReader(buf)
+	require.NoError(t, err)
+	decompressed, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "data: bbb\n\n", string(decompressed))
+}
+
+func TestEncoderMultiLineComment(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	c := comment{value: "hello\nworld"}
+	NewEncoder(buf, false).Encode(c)
+	assert.Equal(t, ":hello\n:world\n", string(buf.Bytes()))
+}
+
+type eventWithComments struct {
+	publication
+	comments []string
+}
+
+func (e *eventWithComments) Comments() []string { return e.comments }
+
+func TestEncoderWritesEventComments(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	NewEncoder(buf, false).Encode(&eventWithComments{
+		publication: publication{id: "aaa", data: "bbb"},
+		comments:    []string{"first", "second\nthird"},
+	})
+	assert.Equal(t, ":first\n:second\n:third\nid: aaa\ndata: bbb\n\n", string(buf.Bytes()))
+
+	ev, err := NewDecoder(buf).Decode()
+	require.NoError(t, err)
+	assert.Equal(t, "aaa", ev.Id())
+	assert.Equal(t, "bbb", ev.Data())
+}
+
+type eventWithEncoding struct {
+	publication
+	encoded string
+}
+
+func (e *eventWithEncoding) Encoded() []byte { return []byte(e.encoded) }
+
+func TestEncoderWritesPreEncodedBytes(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	ev := &eventWithEncoding{publication: publication{data: "ignored"}, encoded: "data: cached\n\n"}
+	require.NoError(t, NewEncoder(buf, false).Encode(ev))
+	assert.Equal(t, "data: cached\n\n", buf.String())
+}
+
+func TestEncodeEventMatchesEncoder(t *testing.T) {
+	for _, ev := range []Event{
+		&publication{data: "aaa"},
+		&publication{id: "aaa", event: "bbb", data: "ccc\nddd"},
+		&eventWithComments{publication: publication{data: "aaa"}, comments: []string{"note"}},
+	} {
+		buf := bytes.NewBuffer(nil)
+		require.NoError(t, NewEncoder(buf, false).Encode(ev))
+		assert.Equal(t, buf.String(), string(EncodeEvent(ev)))
+	}
+	assert.Equal(t, "id: aaa\ndata: bbb\n\n", string(EncodeEvent(&publication{id: "aaa", data: "bbb"})))
+}
+
+func TestPreEncode(t *testing.T) {
+	ev := PreEncode(&eventWithComments{
+		publication: publication{id: "aaa", event: "bbb", data: "ccc\nddd"},
+		comments:    []string{"note"},
+	})
+	assert.Equal(t, "aaa", ev.Id())
+	assert.Equal(t, "bbb", ev.Event())
+	assert.Equal(t, "ccc\nddd", ev.Data())
+
+	expected := ":note\nid: aaa\nevent: bbb\ndata: ccc\ndata: ddd\n\n"
+	assert.Equal(t, expected, string(ev.(EventWithEncoding).Encoded()))
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf, true)
+	require.NoError(t, enc.Encode(ev))
+	gz, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	decoded, err := ioutil.ReadAll(gz)
+	require.Equal(t, io.ErrUnexpectedEOF, err) // the stream is flushed but not closed
+	assert.Equal(t, expected, string(decoded))
+}
+
+func TestEncoderEncodesPreEncodedEventWithOtherLineEnding(t *testing.T) {
+	ev := PreEncode(&eventWithComments{
+		publication: publication{id: "aaa", data: "bbb\nccc"},
+		comments:    []string{"note"},
+	})
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, NewEncoderWithOptions(buf, false, EncoderOptionLineEnding("\r\n")).Encode(ev))
+	assert.Equal(t, ":note\r\nid: aaa\r\ndata: bbb\r\ndata: ccc\r\n\r\n", buf.String())
+}
+
+type eventWithIDReset struct {
+	publication
+}
+
+func (e *eventWithIDReset) ResetID() bool { return true }
+
+func TestEncoderWritesEmptyIDForEventWithIDReset(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	enc := NewEncoder(buf, false)
+	require.NoError(t, enc.Encode(&eventWithIDReset{publication{data: "reset"}}))
+	require.NoError(t, enc.Encode(&eventWithIDReset{publication{id: "aaa", data: "not reset"}}))
+	assert.Equal(t, "id: \ndata: reset\n\nid: aaa\ndata: not reset\n\n", buf.String())
+
+	dec := NewDecoder(strings.NewReader("id: old\ndata: a\n\n" + buf.String()))
+	for _, expected := range []string{"old", "", "aaa"} {
+		ev, err := dec.Decode()
+		require.NoError(t, err)
+		assert.Equal(t, expected, ev.(EventWithLastID).LastEventID())
+	}
+}
+
+type indentedJSON map[string]int
+
+func (v indentedJSON) MarshalJSON() ([]byte, error) {
+	return json.MarshalIndent(map[string]int(v), "", "  ")
+}
+
+func TestNewJSONEvent(t *testing.T) {
+	ev, err := NewJSONEvent("1", "update", map[string]int{"a": 1})
+	require.NoError(t, err)
+	assert.Equal(t, "1", ev.Id())
+	assert.Equal(t, "update", ev.Event())
+	assert.Equal(t, `{"a":1}`, ev.Data())
+
+	ev, err = NewJSONEvent("", "", []interface{}{indentedJSON{"a": 1}, "two\nlines"})
+	require.NoError(t, err)
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, NewEncoder(buf, false).Encode(ev))
+	assert.Equal(t, `data: [{"a":1},"two\nlines"]`+"\n\n", buf.String())
+
+	_, err = NewJSONEvent("", "", make(chan int))
+	assert.Error(t, err)
+}
+
+func TestEncoderLineEnding(t *testing.T) {
+	for _, tc := range []struct {
+		ending, expected string
+	}{
+		{"\r\n", ":a\r\n:b\r\nid: 1\r\ndata: c\r\ndata: d\r\n\r\nretry: 100\r\n\r\n"},
+		{"\n", ":a\n:b\nid: 1\ndata: c\ndata: d\n\nretry: 100\n\n"},
+		{"\r", ":a\n:b\nid: 1\ndata: c\ndata: d\n\nretry: 100\n\n"}, // invalid, so replaced with the default
+	} {
+		t.Run(fmt.Sprintf("%q", tc.ending), func(t *testing.T) {
+			buf := bytes.NewBuffer(nil)
+			enc := NewEncoderWithOptions(buf, false, EncoderOptionLineEnding(tc.ending))
+			require.NoError(t, enc.Encode(comment{value: "a\nb"}))
+			require.NoError(t, enc.Encode(&publication{id: "1", data: "c\nd"}))
+			require.NoError(t, enc.Encode(retryDirective(100*time.Millisecond)))
+			assert.Equal(t, tc.expected, buf.String())
+
+			ev, err := NewDecoder(bytes.NewBufferString(tc.expected)).Decode()
+			require.NoError(t, err)
+			assert.Equal(t, "c\nd", ev.Data())
+		})
+	}
+}
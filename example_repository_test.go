@@ -57,8 +57,8 @@ func ExampleRepository() {
 		fmt.Println(err)
 		return
 	}
-	// This will replay the events in order of id
-	for i := 0; i < 3; i++ {
+	// This will replay the events after id 1, in order of id
+	for i := 0; i < 2; i++ {
 		ev := <-stream.Events
 		fmt.Println(ev.Id(), ev.Event(), ev.Data())
 	}
@@ -66,7 +66,6 @@ func ExampleRepository() {
 	// 2 News Article {"Title":"Governments struggle to control global price of gas","Content":"Hot air...."}
 	// 1 News Article {"Title":"Tomorrow is another day","Content":"And so is the day after."}
 	// 3 News Article {"Title":"News for news' sake","Content":"Nothing has happened."}
-	// 1 News Article {"Title":"Tomorrow is another day","Content":"And so is the day after."}
 	// 2 News Article {"Title":"Governments struggle to control global price of gas","Content":"Hot air...."}
 	// 3 News Article {"Title":"News for news' sake","Content":"Nothing has happened."}
 }
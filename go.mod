@@ -3,6 +3,7 @@ module github.com/launchdarkly/eventsource
 go 1.13
 
 require (
+	github.com/andybalholm/brotli v1.1.0
 	github.com/launchdarkly/go-test-helpers/v2 v2.2.0
 	github.com/stretchr/testify v1.6.0
 )
@@ -5,6 +5,8 @@
 // If the Repository interface is implemented on the server, events can be replayed in case of a network disconnection.
 package eventsource
 
+import "context"
+
 // Event is the interface for any event received by the client or sent by the server.
 type Event interface {
 	// Id is an identifier that can be used to allow a client to replay
@@ -32,12 +34,53 @@ type EventWithLastID interface {
 	LastEventID() string
 }
 
+// EventWithComments is an optional interface for an event sent by the server. If an event implements
+// it, the server writes each of the returned strings as a comment line before the event's fields.
+//
+// Comments are ignored by spec-compliant clients, so this can be used to annotate events, for instance
+// for debugging, without affecting how they are received.
+type EventWithComments interface {
+	Comments() []string
+}
+
+// EventWithChannels is an optional interface for an event sent by the server that knows which channels it
+// belongs to. Such an event can be published with Server.PublishEvent, instead of passing the channels
+// separately to Server.Publish.
+type EventWithChannels interface {
+	Channels() []string
+}
+
+// EventWithIDReset is an optional interface for an event sent by the server. If an event implements it and
+// ResetID returns true, then an event whose Id is empty is written with an empty "id:" field, instead of
+// none. As the SSE specification requires, this makes the client forget its last event ID, so that it no
+// longer sends a Last-Event-Id that may be stale, for instance after the channel's IDs have started over.
+type EventWithIDReset interface {
+	ResetID() bool
+}
+
+// EventWithEncoding is an optional interface for an event sent by the server. If an event implements it,
+// the server writes the bytes returned by Encoded as they are, instead of encoding the event's fields
+// (and comments) itself. Compression is still applied separately to each connection. The bytes are only
+// used with the default "\n" line ending: if Server.LineEnding is "\r\n", the fields are encoded as usual.
+//
+// The bytes must be the complete wire format of the event, including the blank line that ends it. Use
+// PreEncode to create such an event from any other Event, so that an event published to many subscribers
+// is only encoded once.
+type EventWithEncoding interface {
+	Encoded() []byte
+}
+
 // Repository is an interface to be used with Server.Register() allowing clients to replay previous events
 // through the server, if history is required.
 type Repository interface {
 	// Gets the Events which should follow on from the specified channel and event id. This method may be called
 	// from different goroutines, so it must be safe for concurrent access.
 	//
+	// The id is the client's Last-Event-Id, so the event with that id has already been sent to the client and
+	// must not be included; only events published after it should be. If id is empty, all of the channel's
+	// events should be included. SliceRepository and RedisRepository compare ids as strings,
+	// unless Server.CompareIDs is set.
+	//
 	// It is important for the Repository to close the channel after all the necessary events have been
 	// written to it. The stream will not be able to proceed to any new events until it has finished consuming
 	// the channel that was returned by Replay.
@@ -46,7 +89,73 @@ type Repository interface {
 	Replay(channel, id string) chan Event
 }
 
-// Logger is the interface for a custom logging implementation that can handle log output for a Stream.
+// RepositoryWithContext is an optional interface for a Repository whose replays can be cancelled. If the
+// Repository registered for a channel implements it, the Server calls ReplayWithContext instead of Replay.
+type RepositoryWithContext interface {
+	Repository
+	// ReplayWithContext is the same as Replay, except that if ctx is cancelled before all of the events have
+	// been written to the channel, the Repository should stop writing them and close the channel. The Server
+	// cancels ctx when the subscriber's handler exits, for instance because the client has disconnected in
+	// the middle of a long replay.
+	ReplayWithContext(ctx context.Context, channel, id string) chan Event
+}
+
+// RepositoryWithCompleteness is an optional interface for a Repository that discards old events. If the
+// Repository registered for a channel implements it, then whenever it no longer has all of the events that
+// a client asked to have replayed, the Server follows the replayed events with a "_replay_incomplete" event
+// whose data is the client's Last-Event-Id, so that the client knows it must resynchronize in some other way.
+type RepositoryWithCompleteness interface {
+	Repository
+	// HasCompleteHistory returns true if the events that Replay returns for the specified channel and event id
+	// will include every event that was published after that id. It is called just before Replay, from the
+	// Server's background goroutine, which also broadcasts events, so it should return quickly.
+	HasCompleteHistory(channel, id string) bool
+}
+
+// CursorRepository is an optional interface for a Repository that identifies the position from which to
+// replay events by an opaque cursor, such as a database's pagination token, rather than by an event id. If
+// the Repository registered for a channel implements it, and a client's request has a "cursor" query
+// parameter, the Server calls ReplayFrom with the parameter's value instead of calling Replay. Otherwise,
+// events are replayed by id as usual.
+type CursorRepository interface {
+	Repository
+	// ReplayFrom is the same as Replay, except that the events to be included are those after the position
+	// identified by cursor, which is never empty. Events from a channel's history can carry the cursors that
+	// identify their positions in their data, for clients to use when they reconnect.
+	ReplayFrom(channel, cursor string) chan Event
+}
+
+// RepositoryWithAdd is implemented by Repositories, such as SliceRepository, that can store new events. If
+// the Repository registered for a channel implements it, the Server adds each event published to that channel.
+// LoadRepository accepts any RepositoryWithAdd.
+type RepositoryWithAdd interface {
+	// Add stores ev as the latest event in the specified channel.
+	Add(channel string, ev Event)
+}
+
+// Broadcaster is an interface for propagating events from one Server to other Server instances, so that
+// clients connected to any instance receive every event. If Server.Broadcaster is set, Publish,
+// PublishWithAcknowledgment and PublishCount pass each event to Broadcast, as well as publishing it
+// locally. Each instance must then give the events that it receives from its peers to
+// Server.PublishFromPeer, which publishes them locally without broadcasting them again.
+//
+// If Server.IDGenerator is set, each event is broadcast after it has been given its ID, once for each
+// channel since the IDs may differ, and PublishFromPeer neither gives it another ID nor adds it to a
+// Repository. So every instance sends the same IDs to its clients, and if they share a Repository, such as
+// a RedisRepository, each event is stored in it once.
+//
+// RedisBroadcaster is an implementation that uses Redis pub/sub.
+type Broadcaster interface {
+	// Broadcast sends an event that was published to the specified channels to the other instances. It is
+	// called from the Server's background goroutine, one event at a time, so publishing does not wait for it;
+	// but while it is slow, broadcasts queue up, and once ServerOptionBackgroundQueueSize of them are waiting,
+	// further events are not broadcast.
+	Broadcast(channels []string, ev Event) error
+}
+
+// Logger is the interface for a custom logging implementation that can handle log output for a Stream
+// or a Server. A *log.Logger implements it; to send the output to another logging library, such as a
+// structured logger, use a small adapter type with these two methods.
 type Logger interface {
 	Println(...interface{})
 	Printf(string, ...interface{})
@@ -0,0 +1,58 @@
+package eventsource
+
+import "time"
+
+// rateLimiter is the token bucket that a handler uses to enforce Server.MaxEventsPerSecond. It holds up to
+// one second's worth of tokens, and starts full.
+type rateLimiter struct {
+	perSecond float64
+	tokens    float64
+	last      time.Time
+}
+
+func newRateLimiter(perSecond int, now time.Time) *rateLimiter {
+	return &rateLimiter{perSecond: float64(perSecond), tokens: float64(perSecond), last: now}
+}
+
+func (l *rateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.perSecond
+	if l.tokens > l.perSecond {
+		l.tokens = l.perSecond
+	}
+	l.last = now
+}
+
+// Takes a token and returns true if one is available.
+func (l *rateLimiter) allow(now time.Time) bool {
+	l.refill(now)
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Returns how long it will be until a token is available.
+func (l *rateLimiter) wait(now time.Time) time.Duration {
+	l.refill(now)
+	if l.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.perSecond * float64(time.Second))
+}
+
+// Adds an event to the events that are being held back, replacing any held event of the same event type.
+// Like coalescingQueue, this never replaces events without a type, since they may not be updates of the same
+// thing.
+func holdEvent(held []Event, ev Event) []Event {
+	if ev.Event() == "" {
+		return append(held, ev)
+	}
+	for i, waiting := range held {
+		if waiting.Event() == ev.Event() {
+			held = append(held[:i], held[i+1:]...)
+			break // there can't be more than one, since each call removes the previous one
+		}
+	}
+	return append(held, ev)
+}
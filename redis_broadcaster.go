@@ -0,0 +1,72 @@
+package eventsource
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// RedisPublisher is the Redis command that RedisBroadcaster uses. Like RedisClient, it is not tied to any
+// particular Redis client library.
+type RedisPublisher interface {
+	// Publish posts a message to a Redis pub/sub channel.
+	Publish(redisChannel, message string) error
+}
+
+// RedisBroadcaster is a Broadcaster that uses Redis pub/sub to propagate events between Server instances.
+// Each instance's Broadcast posts events to the same Redis channel. The application must also subscribe to
+// that Redis channel, with its own Redis client library, and pass each message it receives to Receive.
+//
+// Redis delivers messages to every subscriber, including the instance that posted them, so each message
+// identifies the RedisBroadcaster that sent it, and Receive ignores a RedisBroadcaster's own messages.
+type RedisBroadcaster struct {
+	publisher    RedisPublisher
+	redisChannel string
+	origin       string
+}
+
+type redisBroadcastMessage struct {
+	Origin   string   `json:"origin"`
+	Channels []string `json:"channels"`
+	Event    string   `json:"event"` // in text/event-stream format
+}
+
+// NewRedisBroadcaster creates a RedisBroadcaster that posts events to the specified Redis channel.
+func NewRedisBroadcaster(publisher RedisPublisher, redisChannel string) *RedisBroadcaster {
+	return &RedisBroadcaster{
+		publisher:    publisher,
+		redisChannel: redisChannel,
+		origin:       newConnectionID(),
+	}
+}
+
+// Broadcast implements the Broadcaster interface.
+func (b *RedisBroadcaster) Broadcast(channels []string, ev Event) error {
+	message, err := json.Marshal(redisBroadcastMessage{
+		Origin:   b.origin,
+		Channels: channels,
+		Event:    string(EncodeEvent(ev)),
+	})
+	if err != nil {
+		return err
+	}
+	return b.publisher.Publish(b.redisChannel, string(message))
+}
+
+// Receive publishes an event from a message that was posted to the Redis channel by a RedisBroadcaster on
+// another instance, by calling srv.PublishFromPeer. It ignores the RedisBroadcaster's own messages, and
+// returns an error if the message is not valid.
+func (b *RedisBroadcaster) Receive(srv *Server, message string) error {
+	var m redisBroadcastMessage
+	if err := json.Unmarshal([]byte(message), &m); err != nil {
+		return err
+	}
+	if m.Origin == b.origin {
+		return nil
+	}
+	ev, err := NewDecoder(bytes.NewBufferString(m.Event)).Decode()
+	if err != nil {
+		return err
+	}
+	srv.PublishFromPeer(m.Channels, ev)
+	return nil
+}
@@ -0,0 +1,108 @@
+package eventsource
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedisPubSub delivers each published message to every subscribed instance, including the sender. Like
+// Redis, it delivers them asynchronously.
+type fakeRedisPubSub struct {
+	t           *testing.T
+	subscribers []func(message string) error
+}
+
+func (p *fakeRedisPubSub) Publish(redisChannel, message string) error {
+	assert.Equal(p.t, "events", redisChannel)
+	for _, s := range p.subscribers {
+		go func(s func(message string) error) { assert.NoError(p.t, s(message)) }(s)
+	}
+	return nil
+}
+
+func TestRedisBroadcasterPublishesEventsOnOtherInstances(t *testing.T) {
+	pubsub := &fakeRedisPubSub{t: t}
+	var streams []*http.Response
+	var servers []*Server
+	for i := 0; i < 2; i++ {
+		server := NewServer()
+		defer server.Close()
+		broadcaster := NewRedisBroadcaster(pubsub, "events")
+		server.Broadcaster = broadcaster
+		pubsub.subscribers = append(pubsub.subscribers, func(message string) error {
+			return broadcaster.Receive(server, message)
+		})
+		httpServer := httptest.NewServer(server.Handler("test"))
+		defer httpServer.Close()
+		resp, err := http.Get(httpServer.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		servers = append(servers, server)
+		streams = append(streams, resp)
+	}
+
+	servers[0].Publish([]string{"test"}, &publication{id: "1", event: "greeting", data: "from 0"})
+	servers[1].Publish([]string{"test"}, &publication{id: "2", data: "from 1"})
+
+	// Each instance receives each event once: its own events are not published again when they come back.
+	for _, resp := range streams {
+		events, err := ReadEvents(resp.Body, 2)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1/greeting/from 0", "2//from 1"},
+			[]string{events[0].Id() + "/" + events[0].Event() + "/" + events[0].Data(),
+				events[1].Id() + "/" + events[1].Event() + "/" + events[1].Data()})
+	}
+}
+
+func TestRedisBroadcasterSendsGeneratedIDsToOtherInstances(t *testing.T) {
+	pubsub := &fakeRedisPubSub{t: t}
+	client := newFakeRedisClient()
+	var streams []*http.Response
+	var servers []*Server
+	for i := 0; i < 2; i++ {
+		server := NewServer()
+		defer server.Close()
+		instance, nextID := i, 0
+		server.IDGenerator = func(string) string {
+			nextID++
+			return fmt.Sprintf("%d-%d", instance, nextID) // each instance would generate different IDs
+		}
+		server.Register("test", NewRedisRepository(client, "events:", 10))
+		broadcaster := NewRedisBroadcaster(pubsub, "events")
+		server.Broadcaster = broadcaster
+		pubsub.subscribers = append(pubsub.subscribers, func(message string) error {
+			return broadcaster.Receive(server, message)
+		})
+		httpServer := httptest.NewServer(server.Handler("test"))
+		defer httpServer.Close()
+		resp, err := http.Get(httpServer.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		servers = append(servers, server)
+		streams = append(streams, resp)
+	}
+
+	servers[0].Publish([]string{"test"}, &publication{data: "from 0"})
+
+	// Both instances send the ID that the publishing instance generated, and it is stored once.
+	for _, resp := range streams {
+		events, err := ReadEvents(resp.Body, 1)
+		require.NoError(t, err)
+		assert.Equal(t, "0-1", events[0].Id())
+		assert.Equal(t, "from 0", events[0].Data())
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	assert.Len(t, client.lists["events:test"], 1)
+}
+
+func TestRedisBroadcasterRejectsInvalidMessage(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	assert.Error(t, NewRedisBroadcaster(&fakeRedisPubSub{t: t}, "events").Receive(server, "not JSON"))
+}
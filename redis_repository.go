@@ -0,0 +1,162 @@
+package eventsource
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+)
+
+// RedisClient is the subset of Redis commands that RedisRepository uses. It is not tied to any particular
+// Redis client library: to use one, write a small adapter type that implements these methods by calling
+// the library's commands of the same names.
+type RedisClient interface {
+	// RPush appends a value to the end of the list stored at key, creating the list if it does not exist.
+	RPush(key, value string) error
+	// LTrim trims the list stored at key so that it only contains the elements from start to stop,
+	// inclusive. As in Redis, negative indexes count back from the end of the list.
+	LTrim(key string, start, stop int64) error
+	// LRange returns the elements of the list stored at key from start to stop, inclusive, or an empty
+	// slice if the list does not exist. As in Redis, negative indexes count back from the end of the list.
+	LRange(key string, start, stop int64) ([]string, error)
+}
+
+// RedisRepository is a Repository that stores past events in Redis, so that several Server instances can
+// share one history, and a client can have events replayed to it by any of them. Each channel's events are
+// kept in a Redis list, in the same text/event-stream format that the Server sends to its clients.
+//
+// As with SliceRepository, event IDs are compared as strings, unless the repository is registered with a
+// Server whose CompareIDs is set: Replay returns the events whose IDs come after the client's Last-Event-Id,
+// in the order they were added. Events must be added in the order of their IDs, since Replay reads the list
+// back from the newest event, a page at a time, only until it reaches the client's Last-Event-Id; so a client
+// that missed a few events costs a few Redis reads, however long the list is.
+type RedisRepository struct {
+	client     RedisClient
+	keyPrefix  string
+	maxLen     int64
+	compareIDs func(a, b string) int
+	lock       sync.RWMutex
+
+	// Logger, if set, is used to log errors from the RedisClient, which Add and Replay can't return.
+	Logger Logger
+}
+
+// redisDefaultMaxLen is the number of events per channel that a RedisRepository keeps if maxLen is not set.
+const redisDefaultMaxLen = 1000
+
+// redisReplayPageSize is the number of events that Replay reads from Redis at a time.
+const redisReplayPageSize = 100
+
+// NewRedisRepository creates a RedisRepository. Each channel's events are stored in the list whose key is
+// keyPrefix followed by the channel name. Only the most recent maxLen events of each channel are kept, or
+// 1000 if maxLen is zero or less, so that the lists can't grow without limit.
+func NewRedisRepository(client RedisClient, keyPrefix string, maxLen int) *RedisRepository {
+	if maxLen <= 0 {
+		maxLen = redisDefaultMaxLen
+	}
+	return &RedisRepository{
+		client:     client,
+		keyPrefix:  keyPrefix,
+		maxLen:     int64(maxLen),
+		compareIDs: strings.Compare,
+	}
+}
+
+// Add adds an event to the repository history. The Server calls it for events that are given IDs by
+// Server.IDGenerator, from its background goroutine, so in that case a slow Redis connection delays
+// broadcasts and replays, but not publishing; other events must be added by the application when it publishes
+// them.
+func (repo *RedisRepository) Add(channel string, event Event) {
+	key := repo.keyPrefix + channel
+	if err := repo.client.RPush(key, string(EncodeEvent(event))); err != nil {
+		repo.logError(err)
+		return
+	}
+	if err := repo.client.LTrim(key, -repo.maxLen, -1); err != nil {
+		repo.logError(err)
+	}
+}
+
+// Replay implements the event replay logic for the Repository interface.
+func (repo *RedisRepository) Replay(channel, id string) chan Event {
+	return repo.ReplayWithContext(context.Background(), channel, id)
+}
+
+// ReplayWithContext implements the RepositoryWithContext interface, so that a replay stops if the client
+// disconnects.
+func (repo *RedisRepository) ReplayWithContext(ctx context.Context, channel, id string) chan Event {
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		repo.lock.RLock()
+		compare := repo.compareIDs
+		repo.lock.RUnlock()
+		// This is read here, rather than before starting the goroutine, because Replay is called from the
+		// Server's background goroutine, which must not wait for Redis.
+		events := repo.eventsAfter(ctx, repo.keyPrefix+channel, id, compare)
+		for i := len(events) - 1; i >= 0; i-- {
+			select {
+			case out <- events[i]:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Reads the events whose IDs come after id from the list at key, a page at a time from the newest, and
+// returns them newest first. Since Add may be appending to the list meanwhile, which moves the older
+// entries to lower negative indexes, an entry that is read twice is skipped.
+func (repo *RedisRepository) eventsAfter(ctx context.Context, key, id string, compare func(a, b string) int) []Event {
+	var events []Event
+	for stop := int64(-1); ctx.Err() == nil; stop -= redisReplayPageSize {
+		entries, err := repo.client.LRange(key, stop-redisReplayPageSize+1, stop)
+		if err != nil {
+			repo.logError(err)
+			return nil
+		}
+		for i := len(entries) - 1; i >= 0; i-- {
+			ev := repo.decode(entries[i])
+			if ev == nil || (id != "" && ev.Id() == "") {
+				continue
+			}
+			if id != "" && compare(ev.Id(), id) <= 0 {
+				return events
+			}
+			if len(events) > 0 && ev.Id() != "" && compare(ev.Id(), events[len(events)-1].Id()) >= 0 {
+				continue // already read from the previous page
+			}
+			events = append(events, ev)
+		}
+		if len(entries) < redisReplayPageSize {
+			break
+		}
+	}
+	return events
+}
+
+// Decodes an entry from a Redis list. Returns nil if it isn't a valid event.
+func (repo *RedisRepository) decode(entry string) Event {
+	ev, err := NewDecoder(bytes.NewBufferString(entry)).Decode()
+	if err != nil {
+		if err != io.EOF {
+			repo.logError(err)
+		}
+		return nil
+	}
+	return ev
+}
+
+func (repo *RedisRepository) setCompareIDs(compare func(a, b string) int) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	repo.compareIDs = compare
+}
+
+func (repo *RedisRepository) logError(err error) {
+	if repo.Logger != nil {
+		repo.Logger.Println("eventsource: Redis error:", err)
+	}
+}
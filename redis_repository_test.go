@@ -0,0 +1,182 @@
+package eventsource
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedisClient implements RedisClient with in-memory lists.
+type fakeRedisClient struct {
+	lists   map[string][]string
+	err     error
+	lranges int // the number of LRange calls
+	lock    sync.Mutex
+}
+
+func newFakeRedisClient() *fakeRedisClient {
+	return &fakeRedisClient{lists: make(map[string][]string)}
+}
+
+func (c *fakeRedisClient) RPush(key, value string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.lists[key] = append(c.lists[key], value)
+	return nil
+}
+
+func (c *fakeRedisClient) LTrim(key string, start, stop int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	list := c.lists[key]
+	c.lists[key] = list[c.index(list, start) : c.index(list, stop)+1]
+	return nil
+}
+
+func (c *fakeRedisClient) LRange(key string, start, stop int64) ([]string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lranges++
+	if c.err != nil {
+		return nil, c.err
+	}
+	list := c.lists[key]
+	from, to := c.index(list, start), c.index(list, stop)
+	if to >= len(list) {
+		to = len(list) - 1
+	}
+	if stop < -int64(len(list)) || from > to {
+		return nil, nil // like Redis, a range that is out of bounds is empty
+	}
+	return append([]string(nil), list[from:to+1]...), nil
+}
+
+func (c *fakeRedisClient) index(list []string, i int64) int {
+	if i < 0 {
+		i += int64(len(list))
+	}
+	if i < 0 {
+		return 0
+	}
+	return int(i)
+}
+
+func replayedEvents(repo Repository, channel, id string) []string {
+	var replayed []string
+	for ev := range repo.Replay(channel, id) {
+		replayed = append(replayed, ev.Id()+"/"+ev.Event()+"/"+ev.Data())
+	}
+	return replayed
+}
+
+func TestRedisRepositoryReplaysEventsAfterID(t *testing.T) {
+	client := newFakeRedisClient()
+	repo := NewRedisRepository(client, "events:", 0)
+	repo.Add("test", &publication{id: "1", data: "first"})
+	repo.Add("test", &publication{id: "2", event: "update", data: "second\nline"})
+	repo.Add("test", &publication{id: "3", data: "third"})
+	repo.Add("other", &publication{id: "4", data: "elsewhere"})
+
+	assert.Equal(t, []string{"id: 4\ndata: elsewhere\n\n"}, client.lists["events:other"])
+	assert.Equal(t, []string{"1//first", "2/update/second\nline", "3//third"}, replayedEvents(repo, "test", ""))
+	assert.Equal(t, []string{"2/update/second\nline", "3//third"}, replayedEvents(repo, "test", "1"))
+	assert.Empty(t, replayedEvents(repo, "test", "3"))
+	assert.Empty(t, replayedEvents(repo, "unknown", ""))
+}
+
+func TestRedisRepositoryUsesServerCompareIDs(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.CompareIDs = CompareNumericIDs
+
+	repo := NewRedisRepository(newFakeRedisClient(), "", 0)
+	server.Register("test", repo)
+	for _, id := range []string{"9", "10", "11"} {
+		repo.Add("test", &publication{id: id, data: id})
+	}
+	assert.Equal(t, []string{"10//10", "11//11"}, replayedEvents(repo, "test", "9"))
+}
+
+func TestRedisRepositoryKeepsOnlyMaxLenEvents(t *testing.T) {
+	repo := NewRedisRepository(newFakeRedisClient(), "", 2)
+	repo.Add("test", &publication{id: "1", data: "first"})
+	repo.Add("test", &publication{id: "2", data: "second"})
+	repo.Add("test", &publication{id: "3", data: "third"})
+
+	assert.Equal(t, []string{"2//second", "3//third"}, replayedEvents(repo, "test", ""))
+}
+
+func TestRedisRepositoryKeepsDefaultMaxLenEvents(t *testing.T) {
+	client := newFakeRedisClient()
+	repo := NewRedisRepository(client, "", 0)
+	for i := 1; i <= redisDefaultMaxLen+1; i++ {
+		repo.Add("test", &publication{id: fmt.Sprintf("%04d", i)})
+	}
+	assert.Len(t, client.lists["test"], redisDefaultMaxLen)
+	assert.Equal(t, "id: 0002\ndata: \n\n", client.lists["test"][0])
+}
+
+func TestRedisRepositoryOnlyReadsEventsAfterID(t *testing.T) {
+	client := newFakeRedisClient()
+	repo := NewRedisRepository(client, "", 0)
+	for i := 1; i <= 250; i++ {
+		repo.Add("test", &publication{id: fmt.Sprintf("%03d", i), data: "x"})
+	}
+
+	assert.Equal(t, []string{"249//x", "250//x"}, replayedEvents(repo, "test", "248"))
+	assert.Equal(t, 1, client.lranges)
+
+	// Replays that go back further than a page read more pages, and put them in order.
+	replayed := replayedEvents(repo, "test", "005")
+	require.Len(t, replayed, 245)
+	assert.Equal(t, "006//x", replayed[0])
+	assert.Equal(t, "250//x", replayed[244])
+	assert.Equal(t, 4, client.lranges)
+	assert.Len(t, replayedEvents(repo, "test", ""), 250)
+}
+
+func TestRedisRepositoryLogsClientErrors(t *testing.T) {
+	client := newFakeRedisClient()
+	client.err = errors.New("connection refused")
+	logger := &recordingLogger{}
+	repo := NewRedisRepository(client, "", 0)
+	repo.Logger = logger
+
+	repo.Add("test", &publication{id: "1", data: "first"})
+	assert.Empty(t, replayedEvents(repo, "test", ""))
+	require.Len(t, logger.lines, 2)
+	assert.Equal(t, "eventsource: Redis error: connection refused", logger.lines[0])
+}
+
+func TestServerReplaysEventsFromRedisRepository(t *testing.T) {
+	client := newFakeRedisClient()
+	// The events could have been added by another Server instance that shares the same Redis database.
+	NewRedisRepository(client, "", 0).Add("test", &publication{id: "1", data: "first"})
+	NewRedisRepository(client, "", 0).Add("test", &publication{id: "2", data: "second"})
+
+	server := NewServer()
+	defer server.Close()
+	server.Register("test", NewRedisRepository(client, "", 0))
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	req, err := http.NewRequest("GET", httpServer.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	events, err := ReadEvents(resp.Body, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "second", events[0].Data())
+}
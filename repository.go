@@ -1,53 +1,151 @@
 package eventsource
 
 import (
+	"context"
+	"io"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 )
 
-// SliceRepository is an example repository that uses a slice as storage for past events.
+// CompareNumericIDs compares event IDs as integers, for use as Server.CompareIDs: it returns a negative
+// number if a is less than b, zero if they are equal, and a positive number if a is greater than b. If either
+// ID is not an integer, they are compared as strings instead.
+func CompareNumericIDs(a, b string) int {
+	x, errA := strconv.ParseInt(a, 10, 64)
+	y, errB := strconv.ParseInt(b, 10, 64)
+	switch {
+	case errA != nil || errB != nil:
+		return strings.Compare(a, b)
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// SliceRepository is an example repository that uses a slice as storage for past events. Events are kept
+// in order of their IDs, which are compared as strings unless it is registered with a Server whose
+// CompareIDs is set.
 type SliceRepository struct {
-	events map[string][]Event
-	lock   *sync.RWMutex
+	events     map[string][]Event
+	lock       *sync.RWMutex
+	compareIDs *func(a, b string) int // shared by copies of the repository, and guarded by lock
 }
 
 // NewSliceRepository creates a SliceRepository.
 func NewSliceRepository() *SliceRepository {
+	compare := strings.Compare
 	return &SliceRepository{
-		events: make(map[string][]Event),
-		lock:   &sync.RWMutex{},
+		events:     make(map[string][]Event),
+		lock:       &sync.RWMutex{},
+		compareIDs: &compare,
+	}
+}
+
+func (repo *SliceRepository) setCompareIDs(compare func(a, b string) int) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	*repo.compareIDs = compare
+	for channel, events := range repo.events { // existing events must be put in the new order
+		sort.SliceStable(events, func(i, j int) bool { return compare(events[i].Id(), events[j].Id()) < 0 })
+		repo.events[channel] = events
 	}
 }
 
+// Must be called with the lock held.
 func (repo SliceRepository) indexOfEvent(channel, id string) int {
+	compare := *repo.compareIDs
 	return sort.Search(len(repo.events[channel]), func(i int) bool {
-		return repo.events[channel][i].Id() >= id
+		return compare(repo.events[channel][i].Id(), id) >= 0
 	})
 }
 
-// Replay implements the event replay logic for the Repository interface.
+// Replay implements the event replay logic for the Repository interface. It returns the channel's events
+// whose IDs are greater than id, so not the event with that ID itself, which the client has already seen.
 func (repo SliceRepository) Replay(channel, id string) (out chan Event) {
+	return repo.ReplayWithContext(context.Background(), channel, id)
+}
+
+// ReplayWithContext implements the RepositoryWithContext interface, so that a replay stops if the client
+// disconnects. The events are copied before they are sent, so that a client that is slow to read them does not
+// hold the repository's lock, which would block Add, and so the Server's publishing of new events.
+func (repo SliceRepository) ReplayWithContext(ctx context.Context, channel, id string) (out chan Event) {
 	out = make(chan Event)
 	go func() {
 		defer close(out)
-		repo.lock.RLock()
-		defer repo.lock.RUnlock()
-		events := repo.events[channel][repo.indexOfEvent(channel, id):]
+		events := repo.eventsAfter(channel, id)
 		for i := range events {
-			out <- events[i]
+			select {
+			case out <- events[i]:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 	return
 }
 
+// Returns a copy of the channel's events whose IDs are greater than id.
+func (repo SliceRepository) eventsAfter(channel, id string) []Event {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+	i := repo.indexOfEvent(channel, id)
+	if id != "" && i < len(repo.events[channel]) && (*repo.compareIDs)(repo.events[channel][i].Id(), id) == 0 {
+		i++
+	}
+	return append([]Event(nil), repo.events[channel][i:]...)
+}
+
 // Add adds an event to the repository history.
 func (repo *SliceRepository) Add(channel string, event Event) {
 	repo.lock.Lock()
 	defer repo.lock.Unlock()
 	i := repo.indexOfEvent(channel, event.Id())
-	if i < len(repo.events[channel]) && repo.events[channel][i].Id() == event.Id() {
+	if i < len(repo.events[channel]) && (*repo.compareIDs)(repo.events[channel][i].Id(), event.Id()) == 0 {
 		repo.events[channel][i] = event
 	} else {
 		repo.events[channel] = append(repo.events[channel][:i], append([]Event{event}, repo.events[channel][i:]...)...)
 	}
 }
+
+// DumpRepository writes all of a channel's events from a Repository to w, in the same text/event-stream
+// format that a Server sends to its clients. Together with LoadRepository, this can be used to persist a
+// Repository's history across restarts, so that clients reconnecting with an older Last-Event-Id can still
+// have events replayed to them.
+func DumpRepository(w io.Writer, channel string, repo Repository) error {
+	events := repo.Replay(channel, "")
+	if events == nil {
+		return nil
+	}
+	enc := NewEncoder(w, false)
+	defer enc.release()
+	var err error
+	for ev := range events {
+		if err == nil {
+			err = enc.Encode(ev)
+		}
+		// After an error, keep reading so that the Repository's Replay goroutine can finish
+	}
+	return err
+}
+
+// LoadRepository reads events in text/event-stream format from r, such as those written by DumpRepository,
+// and adds each of them to a channel in repo, which can be a SliceRepository or any other RepositoryWithAdd.
+// It returns nil when it reaches the end of r, or else the first read error.
+func LoadRepository(r io.Reader, channel string, repo RepositoryWithAdd) error {
+	dec := NewDecoder(r)
+	for {
+		ev, err := dec.Decode()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		repo.Add(channel, ev)
+	}
+}
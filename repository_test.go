@@ -0,0 +1,121 @@
+package eventsource
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpAndLoadRepository(t *testing.T) {
+	repo := NewSliceRepository()
+	repo.Add("test", &publication{id: "1", data: "first"})
+	repo.Add("test", &publication{id: "2", event: "update", data: "second\nline"})
+	repo.Add("other", &publication{id: "3", data: "elsewhere"})
+
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, DumpRepository(buf, "test", repo))
+	assert.Equal(t, "id: 1\ndata: first\n\nid: 2\nevent: update\ndata: second\ndata: line\n\n", buf.String())
+
+	loaded := NewSliceRepository()
+	require.NoError(t, LoadRepository(buf, "restored", loaded))
+
+	var replayed []string
+	for ev := range loaded.Replay("restored", "1") {
+		replayed = append(replayed, ev.Id()+"/"+ev.Event()+"/"+ev.Data())
+	}
+	assert.Equal(t, []string{"2/update/second\nline"}, replayed)
+}
+
+func TestDumpRepositoryReturnsWriteError(t *testing.T) {
+	repo := NewSliceRepository()
+	repo.Add("test", &publication{id: "1", data: "first"})
+	repo.Add("test", &publication{id: "2", data: "second"})
+
+	err := DumpRepository(failingWriter{}, "test", repo)
+	assert.EqualError(t, err, "eventsource encode: connection reset")
+
+	// The Replay goroutine must have finished and released the lock
+	repo.Add("test", &publication{id: "3", data: "third"})
+}
+
+func TestSliceRepositoryReplaysOnlyEventsAfterID(t *testing.T) {
+	repo := NewSliceRepository()
+	for _, id := range []string{"2", "4", "6"} {
+		repo.Add("test", &publication{id: id, data: id})
+	}
+	for _, tc := range []struct {
+		id       string
+		expected []string
+	}{
+		{"", []string{"2", "4", "6"}},
+		{"1", []string{"2", "4", "6"}},
+		{"2", []string{"4", "6"}}, // the client has already seen the event with its Last-Event-Id
+		{"3", []string{"4", "6"}},
+		{"6", nil},
+		{"7", nil},
+	} {
+		t.Run(fmt.Sprintf("after %q", tc.id), func(t *testing.T) {
+			var replayed []string
+			for ev := range repo.Replay("test", tc.id) {
+				replayed = append(replayed, ev.Id())
+			}
+			assert.Equal(t, tc.expected, replayed)
+		})
+	}
+}
+
+func TestSliceRepositoryAddDoesNotWaitForUnreadReplay(t *testing.T) {
+	repo := NewSliceRepository()
+	for _, id := range []string{"1", "2", "3"} {
+		repo.Add("test", &publication{id: id, data: id})
+	}
+	replayed := repo.Replay("test", "")
+	assert.Equal(t, "1", (<-replayed).Id()) // and then stop reading, like a slow client
+
+	addedCh := make(chan struct{})
+	go func() {
+		repo.Add("test", &publication{id: "4", data: "4"})
+		close(addedCh)
+	}()
+	select {
+	case <-addedCh:
+	case <-time.After(time.Second):
+		require.Fail(t, "timed out waiting for Add")
+	}
+
+	var rest []string
+	for ev := range replayed {
+		rest = append(rest, ev.Id())
+	}
+	assert.Equal(t, []string{"2", "3"}, rest) // the replay is of the events at the time it started
+}
+
+func TestSliceRepositoryUsesServerCompareIDs(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.CompareIDs = CompareNumericIDs
+
+	repo := NewSliceRepository()
+	repo.Add("test", &publication{id: "10", data: "ten"})
+	server.Register("test", repo) // events added before registration are put in numeric order too
+	for _, id := range []string{"9", "11", "100"} {
+		repo.Add("test", &publication{id: id, data: id})
+	}
+
+	var replayed []string
+	for ev := range repo.Replay("test", "9") {
+		replayed = append(replayed, ev.Id())
+	}
+	assert.Equal(t, []string{"10", "11", "100"}, replayed)
+}
+
+func TestCompareNumericIDs(t *testing.T) {
+	assert.Less(t, CompareNumericIDs("9", "10"), 0)
+	assert.Greater(t, CompareNumericIDs("10", "9"), 0)
+	assert.Zero(t, CompareNumericIDs("10", "10"))
+	assert.Less(t, CompareNumericIDs("10", "9a"), 0) // compared as strings
+}
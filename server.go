@@ -1,29 +1,111 @@
 package eventsource
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
 type subscription struct {
+	id          string
+	seq         uint64 // order in which the Server received the subscription
 	channel     string
 	lastEventID string
+	cursor      string          // the request's "cursor" query parameter, for a CursorRepository
+	replayCtx   context.Context // cancelled when the handler exits
+	info        SubscriptionInfo
+	filter      func(Event) bool
+	transform   func(ev Event, bufferLen, bufferCap int) Event
 	out         chan<- eventOrComment
+	queue       *coalescingQueue // if Server.Coalesce is set, events go here, and from here to out
+	status      chan int         // receives the HTTP status once the Server has accepted or rejected the subscription
+	closeReason DisconnectReason // why the Server closed out, if it did
+	closedCh    chan struct{}    // closed at the same time as out, but without waiting for the buffered events
+	closedAt    time.Time        // when the Server closed out, if it did
+}
+
+// DisconnectReason describes why a Server stopped streaming events to a subscriber.
+type DisconnectReason int
+
+const (
+	// DisconnectClientClosed means that the client closed the connection.
+	DisconnectClientClosed DisconnectReason = iota
+	// DisconnectWriteError means that writing to the connection failed.
+	DisconnectWriteError
+	// DisconnectSlowConsumer means that the subscriber fell more than Server.BufferSize events behind.
+	DisconnectSlowConsumer
+	// DisconnectMaxConnTime means that the connection was open for Server.MaxConnTime.
+	DisconnectMaxConnTime
+	// DisconnectUnregistered means that the channel was unregistered with forceDisconnect set.
+	DisconnectUnregistered
+	// DisconnectServerClosed means that the Server was closed.
+	DisconnectServerClosed
+	// DisconnectMaxStreamDuration means that the stream was open for Server.MaxStreamDuration.
+	DisconnectMaxStreamDuration
+	// DisconnectChannelClosed means that the channel was closed with Server.CloseChannel.
+	DisconnectChannelClosed
+	// DisconnectPanic means that the subscription's filter or transform function, or the Repository that was
+	// replaying events to it, panicked.
+	DisconnectPanic
+)
+
+// String returns a short description of the reason, for logging.
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectClientClosed:
+		return "client closed"
+	case DisconnectWriteError:
+		return "write error"
+	case DisconnectSlowConsumer:
+		return "slow consumer"
+	case DisconnectMaxConnTime:
+		return "max connection time"
+	case DisconnectUnregistered:
+		return "unregistered"
+	case DisconnectServerClosed:
+		return "server closed"
+	case DisconnectMaxStreamDuration:
+		return "max stream duration"
+	case DisconnectChannelClosed:
+		return "channel closed"
+	case DisconnectPanic:
+		return "panic"
+	default:
+		return "unknown"
+	}
 }
 
 type eventOrComment interface{}
 
 type outbound struct {
 	channels       []string
+	connectionID   string // if set, the event is only sent to this subscription
 	eventOrComment eventOrComment
 	ackCh          chan<- struct{}
+	countCh        chan<- int // if set, receives the number of subscriptions the event was queued for
+	flush          bool       // if set, the event is flushed as soon as it is written, even if FlushInterval is set
+	broadcast      bool       // if set, the event is passed to the Broadcaster once it has been given its IDs
+	fromPeer       bool       // if set, the event came from another Server's Broadcaster, which gave it its IDs
+}
+
+// flushNow wraps an event published with PublishNow on its way to a subscription's handler.
+type flushNow struct {
+	value eventOrComment
 }
 
 type registration struct {
 	channel    string
 	repository Repository
+	doneCh     chan<- struct{} // receives a value once the registration has been applied
 }
 
 type unregistration struct {
@@ -31,12 +113,71 @@ type unregistration struct {
 	forceDisconnect bool
 }
 
+type channelSwitch struct {
+	connectionID string
+	channel      string
+	resultCh     chan<- int // receives http.StatusOK, or the status for the reason the switch failed
+}
+
+// channelSwitched is sent to a subscription's handler after the subscription has moved to another channel,
+// so that the handler passes the new channel to the callbacks for the events that follow it.
+type channelSwitched struct {
+	channel string
+}
+
+type subscriptionsQuery struct {
+	channel  string
+	resultCh chan<- []SubscriptionInfo
+}
+
+type lastEventIDQuery struct {
+	channel  string
+	resultCh chan<- string
+}
+
 type comment struct {
 	value string
 }
 
+// retryDirective is encoded as a "retry" field, which sets the client's reconnection delay.
+type retryDirective time.Duration
+
+// eventBatch is sent to a subscription in place of the events that are replayed to it. They are read from
+// the Repository on the Server's background goroutine, and sent to events, which is closed after result is set.
 type eventBatch struct {
 	events <-chan Event
+	result *replayResult
+}
+
+type replayResult struct {
+	incomplete bool // true if the Repository reported that events after the requested ID were discarded
+	panicked   bool // true if the Repository panicked, so the subscription must be closed
+}
+
+// eventWithID wraps an event that was published without an ID, to give it the ID from Server.IDGenerator.
+// It passes on the wrapped event's comments, but not an EventWithEncoding's bytes, which don't have the ID.
+type eventWithID struct {
+	wrapped Event
+	id      string
+}
+
+//nolint:golint,stylecheck // must match the Event interface
+func (e *eventWithID) Id() string    { return e.id }
+func (e *eventWithID) Event() string { return e.wrapped.Event() }
+func (e *eventWithID) Data() string  { return e.wrapped.Data() }
+
+// Comments returns the wrapped event's comments, if it is an EventWithComments.
+func (e *eventWithID) Comments() []string {
+	if withComments, ok := e.wrapped.(EventWithComments); ok {
+		return withComments.Comments()
+	}
+	return nil
+}
+
+// repositoryWithIDComparison is implemented by the Repositories in this package, so that Register can give
+// them Server.CompareIDs.
+type repositoryWithIDComparison interface {
+	setCompareIDs(compare func(a, b string) int)
 }
 
 // Server manages any number of event-publishing channels and allows subscribers to consume them.
@@ -46,30 +187,193 @@ type Server struct {
 	ReplayAll       bool          // Replay repository even if there's no Last-Event-Id specified
 	BufferSize      int           // How many messages do we let the client get behind before disconnecting
 	Gzip            bool          // Enable compression if client can accept it
+	GzipLevel       int           // The compression level, such as gzip.BestSpeed; defaults to gzip.DefaultCompression
+	Brotli          bool          // Enable brotli compression if client can accept it; it is preferred over gzip
 	MaxConnTime     time.Duration // If non-zero, HTTP connections will be automatically closed after this time
+	EventTypesParam string        // If set, clients may list the event types they want in this query parameter
+	FlushInterval   time.Duration // If non-zero, flush at most once per interval instead of after every event
+	OrderedFanOut   bool          // Deliver each event to a channel's subscribers in the order they subscribed
+	SendCaughtUp    bool          // After a replay, even an empty one, send a "_caught_up" event with the latest ID
+	ReplayDoneEvent string        // If set, after replaying events, send an event of this type, like SendCaughtUp
+	BufferReplay    bool          // Flush replayed events only at the end of the replay, so they compress better
+	KeepAlive       time.Duration // If non-zero, send an empty comment to any subscriber that has been idle this long
+	HeartbeatEvent  string        // If set, KeepAlive sends an event of this type, with empty data, instead of a comment
+	ReconnectLink   string        // If set, sent in a Link header as an alternate URL that clients can reconnect to
+	WriteTimeout    time.Duration // If non-zero, disconnect a client if writing or flushing to it takes this long
+	AllowedOrigins  []string      // If non-empty, other origins get a 403, and these get CORS headers with credentials
+	RequireReplay   bool          // Respond with 204 to a Last-Event-ID if the channel has no Repository to replay
+	StrictAccept    bool          // Respond with 406 unless the request's Accept header lists text/event-stream
+	Coalesce        bool          // Let a subscriber that falls behind skip to the latest event of each event type
+	RetryBase       time.Duration // If non-zero, tell each client to wait this long, plus RetryJitter, to reconnect
+	RetryJitter     time.Duration // The maximum random delay added to RetryBase, to spread out reconnections
+	LineEnding      string        // Set to "\r\n" for clients that need CRLF line endings; the default is "\n"
 	Logger          Logger        // Logger is a logger that, when set, will be used for logging debug messages
+
+	// DrainTimeout, if non-zero, limits how long a handler keeps writing the events that are still in its
+	// subscriber's buffer after the Server has closed the subscription with Close, CloseChannel, or
+	// Unregister with forceDisconnect. Once it elapses, the handler disconnects the client, and any events
+	// still buffered are passed to OnUndelivered. If it is zero, the handler writes all of them first. A write
+	// that is blocked because the client has stopped reading is interrupted by the connection's write deadline,
+	// as with WriteTimeout, so the ResponseWriter must support http.ResponseController's SetWriteDeadline
+	// (before Go 1.20, a SetWriteDeadline method); otherwise such a handler waits until the write finishes.
+	DrainTimeout time.Duration
+
+	// MaxStreamDuration, if non-zero, limits how long each stream can last. Unlike MaxConnTime, which just
+	// closes the connection, this sends the client a "close" event first, so that a client that is aware of
+	// the limit can tell a deliberate end of the stream from a network failure.
+	MaxStreamDuration time.Duration
+
+	// SendInitialPadding, if true, makes each handler send an ":ok" comment as soon as it starts streaming, so
+	// that proxies which hold back a response until they have some of its body pass it on immediately. If
+	// InitialPaddingSize is larger than that comment, the comment is padded with spaces to that many bytes, for
+	// proxies that wait for a minimum amount of data, such as 2KB.
+	SendInitialPadding bool
+	InitialPaddingSize int
+
+	// MaxSubscribersPerChannel, if non-zero, is the maximum number of concurrent subscribers for any one
+	// channel. Requests for a new subscription beyond that number get an HTTP 503 response.
+	MaxSubscribersPerChannel int
+
+	// MaxChannels, if non-zero, is the maximum number of channels that can have subscribers at the same time.
+	// Requests for a new subscription to a channel that has no subscribers get an HTTP 503 response while
+	// that many other channels have them. Without a limit, a client that subscribes to many distinct channel
+	// names can make the Server use an unbounded amount of memory.
+	MaxChannels int
+
+	// MaxEventsPerSecond, if non-zero, limits how many published events each subscriber is sent per second,
+	// to save bandwidth for clients that don't need every update; up to a second's worth can be sent at once.
+	// Events over the limit are dropped, unless CoalesceRateLimited is set, in which case they are held back
+	// until the limit allows, keeping only the most recent held event of each event type, but every event
+	// without a type. Comments, replayed events, and events published with PublishNow are not limited, and
+	// events that are dropped or still held back when the stream ends are not passed to OnUndelivered.
+	MaxEventsPerSecond  int
+	CoalesceRateLimited bool
+
+	// ValidateLastEventID, if set, is called with the channel and the client's Last-Event-ID header, if it sent
+	// one, before the subscription is created. If it returns an error, the handler responds with HTTP 400 and
+	// the error message. Otherwise, the ID it returns is used in place of the header's value, so it can also
+	// be used to normalize IDs before they are passed to the Repository.
+	ValidateLastEventID func(channel, id string) (string, error)
+
+	// Authorize, if set, is called with each request and its channel before the handler writes any headers
+	// or subscribes. If it returns an error, the handler responds with HTTP 403 instead of streaming, unless
+	// the error is, or wraps, an *AuthError that specifies another status or headers; the error's text is not
+	// sent to the client. It is called from the handler's goroutine.
+	Authorize func(req *http.Request, channel string) error
+
+	// CompareIDs, if set, determines the order of event IDs for the Repositories in this package, such as
+	// SliceRepository, when they are registered with Register: it must return a negative number if a comes
+	// before b, zero if they are equal, and a positive number if a comes after b. By default, IDs are
+	// compared as strings, so for example "10" comes before "9"; CompareNumericIDs can be used instead for
+	// IDs that are integers. Other Repositories must order IDs themselves.
+	CompareIDs func(a, b string) int
+
+	// Marshaler, if set, is called with each event that is published with Publish or one of the similar
+	// methods, from the publishing goroutine, and the event that it returns is published in its place. This
+	// lets an application publish its own types, as long as they implement Event, and turn them into the
+	// event types and data formats that its clients expect in one place. If it returns an error, the event
+	// is not published, and OnMarshalError is called with the original event and the error, or the error is
+	// logged if OnMarshalError is not set. Events replayed from a Repository are not passed to Marshaler.
+	Marshaler      func(ev Event) (Event, error)
+	OnMarshalError func(ev Event, err error)
+
+	// Broadcaster, if set, is used to propagate published events to other Server instances; see Broadcaster.
+	Broadcaster Broadcaster
+
+	// OnConnect, if set, is called with the channel and connection ID whenever a handler starts streaming
+	// to a new subscriber. The same ID is sent to the client in the X-Connection-ID response header.
+	OnConnect func(channel, connectionID string)
+
+	// IDGenerator, if set, is called to assign an ID to every event that is published without one, other than
+	// an EventWithIDReset that resets the client's ID. It is called once per channel that the event is
+	// published to, from the Server's main goroutine, so the IDs it returns are in the same order as the
+	// events. If it panics, the event is not published to that channel. If the channel's registered
+	// Repository is a RepositoryWithAdd, like SliceRepository, the event is also added to it with its new ID
+	// so that it can be replayed to clients that reconnect with a Last-Event-Id. That is done on the Server's
+	// background goroutine, so that a slow Repository does not delay publishing; see QueueStats. The event that
+	// subscribers' filters and transform functions receive then wraps the published event, and keeps its
+	// EventWithComments comments.
+	IDGenerator func(channel string) string
+
+	// OnSubscribe and OnUnsubscribe, if set, are called whenever a subscriber is added to or removed from a
+	// channel, with the number of subscribers the channel now has. A count of 1 from OnSubscribe means that
+	// the channel has just gained its first subscriber, and a count of 0 from OnUnsubscribe means that it has
+	// lost its last one, so these can be used to start and stop producing events for a channel on demand.
+	//
+	// These are called from the Server's main goroutine, so they must return quickly and must not call any
+	// methods of the Server.
+	OnSubscribe   func(channel string, count int)
+	OnUnsubscribe func(channel string, count int)
+
+	// OnUndelivered, if set, is called for each published event that was queued for a subscriber but never
+	// sent, because the connection ended first: that is, the event that was being written when a write
+	// failed, and any events still in the subscriber's buffer when it was closed by the client, by a write
+	// error, by MaxConnTime, or by DrainTimeout. It is not called for comments, or for events that were not yet replayed
+	// from a Repository. It is called from the handler's goroutine.
+	OnUndelivered func(channel string, ev Event)
+
+	// OnDisconnect, if set, is called with the channel and the reason whenever a handler stops streaming to a
+	// subscriber that it had connected. It is called from the handler's goroutine, after OnUndelivered.
+	OnDisconnect func(channel string, reason DisconnectReason)
+
+	// ByteCounter, if set, is called with the channel and the number of bytes each time a handler writes part
+	// of a response body to one of the channel's subscribers, so that the bytes sent for each channel can be
+	// added up. The counts are of the bytes after any compression, and do not include headers. It is called
+	// from the handler's goroutine.
+	ByteCounter func(channel string, n int)
+
 	registrations   chan *registration
 	unregistrations chan *unregistration
 	pub             chan *outbound
 	subs            chan *subscription
 	unsubs          chan *subscription
+	switches        chan *channelSwitch
+	channelCloses   chan string
+	channelLists    chan chan<- []string
+	lastEventIDs    chan *lastEventIDQuery
+	subscriptions   chan *subscriptionsQuery
+	background      chan func() // tasks for runBackground(), which run() closes when it returns
 	quit            chan bool
+	done            chan struct{} // closed when run() returns
 	isClosed        bool
 	isClosedMutex   sync.RWMutex
+	isDraining      bool
+	isDrainingMutex sync.RWMutex
 }
 
+// backgroundQueueSize is the default number of tasks that can wait for the Server's background goroutine
+// before more broadcasts and Repository adds are dropped; see ServerOptionBackgroundQueueSize.
+const backgroundQueueSize = 1000
+
 // NewServer creates a new Server instance.
 func NewServer() *Server {
+	return NewServerWithOptions()
+}
+
+// NewServerWithOptions creates a new Server instance, with optional configuration parameters.
+func NewServerWithOptions(options ...ServerOption) *Server {
 	srv := &Server{
 		registrations:   make(chan *registration),
 		unregistrations: make(chan *unregistration),
 		pub:             make(chan *outbound),
 		subs:            make(chan *subscription),
 		unsubs:          make(chan *subscription, 2),
+		switches:        make(chan *channelSwitch),
+		channelCloses:   make(chan string),
+		channelLists:    make(chan chan<- []string),
+		lastEventIDs:    make(chan *lastEventIDQuery),
+		subscriptions:   make(chan *subscriptionsQuery),
+		background:      make(chan func(), backgroundQueueSize),
 		quit:            make(chan bool),
+		done:            make(chan struct{}),
 		BufferSize:      128,
+		GzipLevel:       gzip.DefaultCompression,
+	}
+	for _, o := range options {
+		o.apply(srv)
 	}
 	go srv.run()
+	go srv.runBackground()
 	return srv
 }
 
@@ -79,114 +383,512 @@ func (srv *Server) Close() {
 	srv.markServerClosed()
 }
 
+// QueueStat is the number of requests waiting in one of the Server's internal queues, and the queue's
+// capacity. A queue with a capacity of zero is unbuffered, so its length is always zero.
+type QueueStat struct {
+	Len int
+	Cap int
+}
+
+// QueueStats reports on the queues through which requests reach the Server's main goroutine, which
+// handles them one at a time, and on the queue of work that it hands off to its background goroutine.
+type QueueStats struct {
+	Publish     QueueStat // events and comments from Publish and PublishComment
+	Subscribe   QueueStat // new subscriptions from handlers
+	Unsubscribe QueueStat // subscriptions whose handlers have ended
+	Register    QueueStat // calls to Register
+	Unregister  QueueStat // calls to Unregister
+	Background  QueueStat // broadcasts, Repository adds and replays waiting for the background goroutine
+}
+
+// QueueStats returns the current state of the Server's internal queues. It can be sampled to detect
+// saturation: for instance, a Publish queue that is often full, with ServerOptionPublishBufferSize, means
+// that fanning events out to subscribers is the bottleneck.
+func (srv *Server) QueueStats() QueueStats {
+	return QueueStats{
+		Publish:     QueueStat{Len: len(srv.pub), Cap: cap(srv.pub)},
+		Subscribe:   QueueStat{Len: len(srv.subs), Cap: cap(srv.subs)},
+		Unsubscribe: QueueStat{Len: len(srv.unsubs), Cap: cap(srv.unsubs)},
+		Register:    QueueStat{Len: len(srv.registrations), Cap: cap(srv.registrations)},
+		Unregister:  QueueStat{Len: len(srv.unregistrations), Cap: cap(srv.unregistrations)},
+		Background:  QueueStat{Len: len(srv.background), Cap: cap(srv.background)},
+	}
+}
+
+// SetDraining changes whether the Server is draining. While draining, handlers refuse new subscriptions
+// with an HTTP 503 status, so that a load balancer can take the instance out of rotation; existing
+// subscriptions continue to receive events until their clients disconnect or MaxConnTime elapses.
+func (srv *Server) SetDraining(draining bool) {
+	srv.isDrainingMutex.Lock()
+	defer srv.isDrainingMutex.Unlock()
+	srv.isDraining = draining
+}
+
+// IsDraining returns true if SetDraining(true) has been called and not reversed.
+func (srv *Server) IsDraining() bool {
+	srv.isDrainingMutex.RLock()
+	defer srv.isDrainingMutex.RUnlock()
+	return srv.isDraining
+}
+
 // Handler creates a new HTTP handler for serving a specified channel.
 //
 // The channel does not have to have been previously registered with Register, but if it has been, the
 // handler may replay events from the registered Repository depending on the setting of server.ReplayAll
 // and the Last-Event-Id header of the request.
 func (srv *Server) Handler(channel string) http.HandlerFunc {
+	return srv.HandlerWithFilter(channel, nil)
+}
+
+// HandlerWithFilter is the same as Handler, except that each published or replayed event is passed to the
+// filter function first, and is only sent to the client if the filter returns true. Comments are not
+// filtered. A nil filter accepts every event.
+//
+// The filter for published events is called from the Server's main goroutine, so it should return quickly.
+// To filter on properties of the request (such as a user ID in the query string), call HandlerWithFilter
+// from within your own handler function and pass the resulting handler the same request.
+func (srv *Server) HandlerWithFilter(channel string, filter func(Event) bool) http.HandlerFunc {
+	return srv.handler(channel, handlerOptions{filter: filter})
+}
+
+// HandlerWithInitialEvents is the same as Handler, except that each time a client connects, eventsFn is
+// called and the events it returns are sent to the client, and flushed one at a time, before any replayed or
+// published events. This can be used to send a snapshot of the current state. If eventsFn returns an error,
+// it is logged, and any events it returned along with the error are still sent; the stream continues either
+// way. The initial events are not passed to any filter.
+func (srv *Server) HandlerWithInitialEvents(channel string, eventsFn func() ([]Event, error)) http.HandlerFunc {
+	return srv.handler(channel, handlerOptions{initial: eventsFn})
+}
+
+// HandlerWithTransform is the same as Handler, except that each published event is passed to the transform
+// function, along with the number of events already waiting in the subscriber's buffer and the buffer's
+// capacity, and the event that it returns is sent instead; if it returns nil, nothing is sent. This can be
+// used to shed load, by sending smaller versions of events to a subscriber that is falling behind. Replayed
+// events and comments are not transformed.
+//
+// Like a filter, the transform function is called from the Server's main goroutine, so it should return
+// quickly.
+func (srv *Server) HandlerWithTransform(channel string, transform func(Event, int, int) Event) http.HandlerFunc {
+	return srv.handler(channel, handlerOptions{transform: transform})
+}
+
+// ChannelHandler is an http.Handler that streams a channel's events, in the same way as the handler
+// returned by HandlerWithFilter. It can be used instead of that function when the handler's configuration
+// needs to be visible to other code, such as middleware that inspects the handler it wraps.
+type ChannelHandler struct {
+	Server  *Server
+	Channel string
+	Filter  func(Event) bool // optional; see HandlerWithFilter
+}
+
+// ServeHTTP implements http.Handler.
+func (h *ChannelHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.Server.HandlerWithFilter(h.Channel, h.Filter)(w, req)
+}
+
+// Mux returns an http.ServeMux with a ChannelHandler for each channel that is currently registered with
+// Register, at the path "/" followed by the channel name. Channels that are registered or unregistered after
+// Mux returns are not affected. The ServeMux can be used directly, or mounted under a prefix with
+// http.StripPrefix.
+func (srv *Server) Mux() *http.ServeMux {
+	resultCh := make(chan []string, 1)
+	srv.channelLists <- resultCh
+	mux := http.NewServeMux()
+	for _, channel := range <-resultCh {
+		mux.Handle("/"+channel, &ChannelHandler{Server: srv, Channel: channel})
+	}
+	return mux
+}
+
+// SubscriptionInfo describes a subscription.
+type SubscriptionInfo struct {
+	// ConnectionID is the subscription's connection ID, which is also sent to the client in the
+	// X-Connection-ID response header.
+	ConnectionID string
+	// Metadata holds the values returned for the subscription's request by the metadata function passed to
+	// HandlerWithMetadata, if any.
+	Metadata map[string]string
+	// Gzip is true if events are sent to the client compressed with gzip.
+	Gzip bool
+	// Encoding is the compression with which events are sent to the client, if any, such as EncodingBrotli.
+	Encoding Encoding
+	// Proto is the protocol of the subscription's request, such as "HTTP/1.1" or "HTTP/2.0".
+	Proto string
+}
+
+// HandlerWithMetadata is the same as HandlerWithFilter, except that the metadata function is called with
+// each request, and the values that it returns, such as a user or tenant ID taken from the request's
+// context, are stored with the subscription. The filter, if not nil, is passed the subscription's
+// SubscriptionInfo, including that metadata, along with each event. The metadata is also reported by
+// Subscriptions.
+//
+// The metadata function is called from the handler's goroutine, but the filter for published events is
+// called from the Server's main goroutine, so it should return quickly, and must not modify the metadata.
+func (srv *Server) HandlerWithMetadata(
+	channel string,
+	metadata func(*http.Request) map[string]string,
+	filter func(Event, SubscriptionInfo) bool,
+) http.HandlerFunc {
+	return srv.handler(channel, handlerOptions{metadata: metadata, infoFilter: filter})
+}
+
+// Subscriptions returns a SubscriptionInfo for each of a channel's current subscriptions, in no particular
+// order.
+func (srv *Server) Subscriptions(channel string) []SubscriptionInfo {
+	resultCh := make(chan []SubscriptionInfo, 1)
+	srv.subscriptions <- &subscriptionsQuery{channel: channel, resultCh: resultCh}
+	return <-resultCh
+}
+
+// handlerOptions holds the optional behaviors of the handlers created by the Handler methods.
+type handlerOptions struct {
+	filter     func(Event) bool
+	initial    func() ([]Event, error)
+	transform  func(ev Event, bufferLen, bufferCap int) Event
+	metadata   func(*http.Request) map[string]string
+	infoFilter func(Event, SubscriptionInfo) bool
+}
+
+func (srv *Server) handler(channel string, opts handlerOptions) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		h := w.Header()
-		h.Set("Content-Type", "text/event-stream; charset=utf-8")
-		h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
-		h.Set("Connection", "keep-alive")
-		if srv.AllowCORS {
-			h.Set("Access-Control-Allow-Origin", "*")
-		}
-		useGzip := srv.Gzip && strings.Contains(req.Header.Get("Accept-Encoding"), "gzip")
-		if useGzip {
-			h.Set("Content-Encoding", "gzip")
+		flusher, ok := srv.acceptStreamRequest(w, req, channel)
+		if !ok {
+			return
 		}
-		w.WriteHeader(http.StatusOK)
+		h := w.Header()
+		connectionID, encoding := srv.setStreamHeaders(h, req)
 
 		// If the Handler is still active even though the server is closed, stop here.
 		// Otherwise the Handler will block while publishing to srv.subs indefinitely.
 		if srv.isServerClosed() {
+			w.WriteHeader(http.StatusOK)
 			return
 		}
 
-		var maxConnTimeCh <-chan time.Time
-		if srv.MaxConnTime > 0 {
-			t := time.NewTimer(srv.MaxConnTime)
-			defer t.Stop()
-			maxConnTimeCh = t.C
+		lastEventID := req.Header.Get("Last-Event-ID")
+		if lastEventID != "" && srv.ValidateLastEventID != nil {
+			var err error
+			if lastEventID, err = srv.ValidateLastEventID(channel, lastEventID); err != nil {
+				h.Del("Content-Encoding")
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 		}
 
-		eventCh := make(chan eventOrComment, srv.BufferSize)
+		bufferSize := srv.BufferSize
+		if srv.Coalesce {
+			bufferSize = 0 // waiting events must stay in the coalescingQueue, where they can still be replaced
+		}
+		eventCh := make(chan eventOrComment, bufferSize)
+		replayCtx, cancelReplay := context.WithCancel(req.Context())
+		defer cancelReplay()
+		info := SubscriptionInfo{ConnectionID: connectionID, Gzip: encoding == EncodingGzip, Encoding: encoding,
+			Proto: req.Proto}
+		if opts.metadata != nil {
+			info.Metadata = opts.metadata(req)
+		}
 		sub := &subscription{
+			id:          connectionID,
 			channel:     channel,
-			lastEventID: req.Header.Get("Last-Event-ID"),
+			lastEventID: lastEventID,
+			cursor:      req.URL.Query().Get("cursor"),
+			replayCtx:   replayCtx,
+			info:        info,
+			filter:      srv.eventTypesFilter(req, opts.filterFor(info)),
+			transform:   opts.transform,
 			out:         eventCh,
+			status:      make(chan int, 1),
+			closedCh:    make(chan struct{}),
+		}
+		var queue *coalescingQueue
+		if srv.Coalesce {
+			queue = newCoalescingQueue(srv.BufferSize)
+			sub.queue = queue
+			defer queue.stop()
+			go queue.pump(eventCh)
+		}
+		select {
+		case srv.subs <- sub:
+		case <-srv.done: // the server was closed after the isServerClosed check above
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if status := <-sub.status; status != http.StatusOK {
+			h.Del("Content-Encoding")
+			if status == http.StatusNoContent {
+				// A 204 response can't have a body; it tells an EventSource client to stop reconnecting.
+				w.WriteHeader(status)
+			} else {
+				http.Error(w, http.StatusText(status), status)
+			}
+			return
 		}
-		srv.subs <- sub
-		flusher := w.(http.Flusher)
+		w.WriteHeader(http.StatusOK)
 		flusher.Flush()
-		enc := NewEncoder(w, useGzip)
+		if srv.OnConnect != nil {
+			srv.OnConnect(channel, connectionID)
+		}
+		srv.newConnection(w, req, flusher, channel, sub, eventCh, queue, encoding, opts).serve()
+	}
+}
 
-		writeEventOrComment := func(ec eventOrComment) bool {
-			if err := enc.Encode(ec); err != nil {
-				srv.unsubs <- sub
-				if srv.Logger != nil {
-					srv.Logger.Println(err)
-				}
-				return false // if this happens, we'll end the handler early because something's clearly broken
+// Checks whether a request may subscribe to a channel. If not, this writes the error response and returns
+// false; otherwise, it returns the http.Flusher that the stream will use.
+func (srv *Server) acceptStreamRequest(w http.ResponseWriter, req *http.Request, channel string) (http.Flusher, bool) {
+	if srv.IsDraining() {
+		http.Error(w, "server is draining", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if req.Method == http.MethodOptions {
+		srv.handlePreflight(w, req)
+		return nil, false
+	}
+	if srv.StrictAccept && !acceptsEventStream(req) {
+		http.Error(w, "this resource is only available as text/event-stream", http.StatusNotAcceptable)
+		return nil, false
+	}
+	if !srv.isOriginAllowed(req.Header.Get("Origin")) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, false
+	}
+	if srv.Authorize != nil {
+		if err := srv.Authorize(req, channel); err != nil {
+			writeAuthError(w, err)
+			return nil, false
+		}
+	}
+	flusher, ok := findFlusher(w)
+	if !ok {
+		// This can happen if the handler is wrapped in middleware whose ResponseWriter hides the Flush method
+		// and has no Unwrap method; without it, events would sit in a buffer instead of being streamed.
+		if srv.Logger != nil {
+			srv.Logger.Println("eventsource: ResponseWriter does not implement http.Flusher, cannot stream")
+		}
+		http.Error(w, "streaming is not supported by this ResponseWriter", http.StatusInternalServerError)
+		return nil, false
+	}
+	return flusher, true
+}
+
+// Sets the headers of a stream's response, and returns its connection ID and the negotiated Encoding.
+func (srv *Server) setStreamHeaders(h http.Header, req *http.Request) (string, Encoding) {
+	h.Set("Content-Type", "text/event-stream; charset=utf-8")
+	h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if req.ProtoMajor < 2 {
+		h.Set("Connection", "keep-alive") // connection-specific headers are not allowed in HTTP/2
+	}
+	srv.setCORSHeaders(h, req)
+	if srv.ReconnectLink != "" {
+		h.Set("Link", "<"+srv.ReconnectLink+">; rel=\"alternate\"")
+	}
+	connectionID := newConnectionID()
+	h.Set("X-Connection-ID", connectionID)
+	encoding := srv.negotiateEncoding(req.Header.Get("Accept-Encoding"))
+	if encoding != EncodingNone {
+		h.Set("Content-Encoding", encoding.ContentEncoding())
+	}
+	return connectionID, encoding
+}
+
+// Returns the filter for a subscription with the given SubscriptionInfo.
+func (opts handlerOptions) filterFor(info SubscriptionInfo) func(Event) bool {
+	if opts.infoFilter == nil {
+		return opts.filter
+	}
+	return func(ev Event) bool { return opts.infoFilter(ev, info) }
+}
+
+// Returns the http.Flusher for a ResponseWriter. Middleware that wraps the ResponseWriter, for instance to log
+// responses, often hides its Flush method, so if it has none this follows the chain of Unwrap methods, which
+// is the same convention that http.ResponseController uses, to the ResponseWriter that it wraps. Events are
+// still written to w, so that the middleware sees them, but this only works if it passes writes straight
+// through rather than buffering them.
+func findFlusher(w http.ResponseWriter) (http.Flusher, bool) {
+	for {
+		if flusher, ok := w.(http.Flusher); ok {
+			return flusher, true
+		}
+		wrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil, false
+		}
+		w = wrapper.Unwrap()
+	}
+}
+
+// byteCountingWriter passes the number of bytes in each successful write to count, for Server.ByteCounter.
+type byteCountingWriter struct {
+	w     io.Writer
+	count func(n int)
+}
+
+func (w *byteCountingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.count(n)
+	}
+	return n, err
+}
+
+// Returns the compression to use for a response, given the request's Accept-Encoding header. Brotli is
+// preferred to gzip whatever their quality values, as long as the client accepts it.
+func (srv *Server) negotiateEncoding(acceptEncoding string) Encoding {
+	if srv.Brotli && acceptsCoding(acceptEncoding, "br") {
+		return EncodingBrotli
+	}
+	if srv.Gzip && (acceptsCoding(acceptEncoding, "gzip") || acceptsCoding(acceptEncoding, "x-gzip")) {
+		return EncodingGzip
+	}
+	return EncodingNone
+}
+
+// Returns true if an Accept-Encoding header lists a content coding, unless its quality value is 0, which
+// means that the client refuses it.
+func acceptsCoding(acceptEncoding, coding string) bool {
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(entry, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), coding) {
+			continue
+		}
+		for _, param := range params[1:] {
+			nameAndValue := strings.SplitN(param, "=", 2)
+			if len(nameAndValue) == 2 && strings.EqualFold(strings.TrimSpace(nameAndValue[0]), "q") {
+				q, err := strconv.ParseFloat(strings.TrimSpace(nameAndValue[1]), 64)
+				return err != nil || q > 0 // an invalid quality value is ignored
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Returns the text of an "ok" comment that will be encoded in at least size bytes.
+func initialPadding(size int) string {
+	const text = "ok"
+	padding := size - len(":"+text+"\n")
+	if padding <= 0 {
+		return text
+	}
+	return text + strings.Repeat(" ", padding)
+}
+
+// Returns true if the request's Accept header explicitly lists the text/event-stream media type. Wildcards
+// are not enough, since a client that sends "*/*" is probably not expecting a stream.
+func acceptsEventStream(req *http.Request) bool {
+	for _, header := range req.Header["Accept"] {
+		for _, mediaRange := range strings.Split(header, ",") {
+			mediaType := strings.TrimSpace(strings.SplitN(mediaRange, ";", 2)[0])
+			if strings.EqualFold(mediaType, "text/event-stream") {
+				return true
 			}
-			flusher.Flush()
+		}
+	}
+	return false
+}
+
+// Sets the Access-Control-Allow-Origin header, and any others that go with it, if AllowCORS or AllowedOrigins
+// allows the request's origin; the origin must already have been checked with isOriginAllowed.
+func (srv *Server) setCORSHeaders(h http.Header, req *http.Request) {
+	if origin := req.Header.Get("Origin"); origin != "" && len(srv.AllowedOrigins) > 0 {
+		// A wildcard isn't allowed for requests with credentials, such as cookies, so the origin is echoed
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Credentials", "true")
+		h.Add("Vary", "Origin")
+	} else if srv.AllowCORS {
+		h.Set("Access-Control-Allow-Origin", "*")
+	}
+}
+
+// Responds to a CORS preflight request, which a browser sends before a cross-origin request with custom
+// headers, such as an EventSource polyfill's, without opening a stream. If the origin is allowed, the
+// response allows GET requests with any of the headers that the browser asked about.
+func (srv *Server) handlePreflight(w http.ResponseWriter, req *http.Request) {
+	if !srv.isOriginAllowed(req.Header.Get("Origin")) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	h := w.Header()
+	srv.setCORSHeaders(h, req)
+	if h.Get("Access-Control-Allow-Origin") != "" {
+		h.Set("Access-Control-Allow-Methods", "GET")
+		if headers := req.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			h.Set("Access-Control-Allow-Headers", headers)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AuthError is an error that Server.Authorize can return to control the response to a request that it
+// rejects, for example to send a 401 status with a WWW-Authenticate header. The handler responds with
+// Status, or 403 if it is zero, and with the headers in Header, if any.
+type AuthError struct {
+	Status int
+	Header http.Header
+}
+
+func (e *AuthError) Error() string {
+	return "eventsource: not authorized: " + http.StatusText(e.status())
+}
+
+func (e *AuthError) status() int {
+	if e.Status == 0 {
+		return http.StatusForbidden
+	}
+	return e.Status
+}
+
+// Writes the response to a request that Server.Authorize rejected with err. The error's text is not sent,
+// since it may contain details that are only meant for the server's logs.
+func writeAuthError(w http.ResponseWriter, err error) {
+	status := http.StatusForbidden
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		status = authErr.status()
+		for name, values := range authErr.Header {
+			w.Header()[name] = values
+		}
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// Returns true if AllowedOrigins is empty or contains the origin. A request without an Origin header is
+// allowed, since browsers omit it for same-origin requests; this check is to stop pages on other sites from
+// opening connections, and is not a substitute for authentication.
+func (srv *Server) isOriginAllowed(origin string) bool {
+	if len(srv.AllowedOrigins) == 0 || origin == "" {
+		return true
+	}
+	for _, allowed := range srv.AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
 			return true
 		}
+	}
+	return false
+}
 
-		// The logic below works as follows:
-		// - Normally, the handler is reading from eventCh. Server.run() accesses this channel through sub.out
-		//   and sends published events to it.
-		// - However, if a Repository is being used, the Server might get a whole batch of events that the
-		//   Repository provides through its Replay method. The Repository provides these in the form of a
-		//   channel that it writes to. Since we don't know how many events there will be or how long it will
-		//   take to write them, we do not want to block Server.run() for this.
-		// - Previous implementations of sending events from Replay used a separate goroutine. That was unsafe,
-		//   due to a race condition where Server.run() might close the channel while the Replay goroutine is
-		//   still writing to it.
-		// - So, instead, Server.run() now takes the channel from Replay and wraps it in an eventBatch. When
-		//   the handler sees an eventBatch, it switches over to reading events from that channel until the
-		//   channel is closed. Then it switches back to reading events from the regular channel.
-		// - The Server can close eventCh at any time to indicate that the stream is done. The handler exits.
-		// - If the client closes the connection, or if MaxConnTime elapses, the handler exits after telling
-		//   the Server to stop publishing events to it.
-
-		var readMainCh <-chan eventOrComment = eventCh
-		var readBatchCh <-chan Event
-		closedNormally := false
-		closeNotify := req.Context().Done()
-
-	ReadLoop:
-		for {
-			select {
-			case <-closeNotify:
-				break ReadLoop
-			case <-maxConnTimeCh: // if MaxConnTime was not set, this is a nil channel and has no effect on the select
-				break ReadLoop
-			case ev, ok := <-readMainCh:
-				if !ok {
-					closedNormally = true
-					break ReadLoop
-				}
-				if batch, ok := ev.(eventBatch); ok {
-					readBatchCh = batch.events
-					readMainCh = nil
-				} else if !writeEventOrComment(ev) {
-					break ReadLoop
-				}
-			case ev, ok := <-readBatchCh:
-				if !ok { // end of batch
-					readBatchCh = nil
-					readMainCh = eventCh
-				} else if !writeEventOrComment(ev) {
-					break ReadLoop
-				}
+// Returns a filter that applies both the handler's filter, if any, and the event types listed by the client
+// in the EventTypesParam query parameter, if any. The parameter can be repeated or contain a comma-separated
+// list; an event whose type is in the list is accepted.
+func (srv *Server) eventTypesFilter(req *http.Request, filter func(Event) bool) func(Event) bool {
+	if srv.EventTypesParam == "" {
+		return filter
+	}
+	types := make(map[string]struct{})
+	for _, param := range req.URL.Query()[srv.EventTypesParam] {
+		for _, t := range strings.Split(param, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				types[t] = struct{}{}
 			}
 		}
-		if !closedNormally {
-			srv.unsubs <- sub // the server didn't tell us to close, so we must tell it that we're closing
+	}
+	if len(types) == 0 {
+		return filter
+	}
+	return func(ev Event) bool {
+		if _, ok := types[ev.Event()]; !ok {
+			return false
 		}
+		return filter == nil || filter(ev)
 	}
 }
 
@@ -195,11 +897,31 @@ func (srv *Server) Handler(channel string) http.HandlerFunc {
 //
 // Channels do not have to be registered unless you want to specify a Repository. An unregistered channel can
 // still be subscribed to with Handler, and published to with Publish.
+//
+// Register returns once the Repository is in use, so every subscription that is made after that, including
+// a reconnection by a client that was already subscribed before the channel was registered, has events
+// replayed from it.
 func (srv *Server) Register(channel string, repo Repository) {
+	if r, ok := repo.(repositoryWithIDComparison); ok && srv.CompareIDs != nil {
+		r.setCompareIDs(srv.CompareIDs)
+	}
+	doneCh := make(chan struct{}, 1)
 	srv.registrations <- &registration{
 		channel:    channel,
 		repository: repo,
+		doneCh:     doneCh,
 	}
+	<-doneCh
+}
+
+// SwapRepository replaces the Repository that is registered for a channel, for instance when migrating
+// between storage backends without downtime. It is equivalent to calling Register again, but makes the
+// handoff explicit: replays that have already started when SwapRepository is called continue to read from
+// the old Repository until it closes their channel, while every subscription that starts after
+// SwapRepository returns replays from the new one. The old Repository should therefore stay usable until
+// its in-flight replays have finished.
+func (srv *Server) SwapRepository(channel string, repo Repository) {
+	srv.Register(channel, repo)
 }
 
 // Unregister removes a channel registration that was created by Register. If forceDisconnect is true, it also
@@ -216,11 +938,58 @@ func (srv *Server) Unregister(channel string, forceDisconnect bool) {
 	}
 }
 
+// CloseChannel disconnects every current subscriber to a channel, without affecting other channels. Their
+// clients will see the end of the stream, and may reconnect. Unlike Unregister, it does not remove the
+// channel's Repository, and new subscriptions to the channel can still be made afterward.
+func (srv *Server) CloseChannel(channel string) {
+	srv.channelCloses <- channel
+}
+
+// LastEventID returns the ID of the most recent event with a non-empty ID that was published to a channel,
+// including an ID assigned by IDGenerator, or "" if there has been none or if the channel's ID was since
+// reset with an EventWithIDReset. Events published with
+// PublishToSubscriber are not counted, since they are not sent to the whole channel.
+func (srv *Server) LastEventID(channel string) string {
+	resultCh := make(chan string, 1)
+	srv.lastEventIDs <- &lastEventIDQuery{channel: channel, resultCh: resultCh}
+	return <-resultCh
+}
+
 // Publish publishes an event to one or more channels.
 func (srv *Server) Publish(channels []string, ev Event) {
+	ev, ok := srv.marshal(ev)
+	if !ok {
+		return
+	}
+	srv.pub <- &outbound{
+		channels:       channels,
+		eventOrComment: ev,
+		broadcast:      true,
+	}
+}
+
+// PublishNow publishes an event to one or more channels, like Publish, but each subscriber's response is
+// flushed as soon as the event has been written, even if FlushInterval is set, along with any events that
+// were written before it and were waiting for the next flush. This is for events that clients are waiting
+// for, such as responses to their own requests.
+func (srv *Server) PublishNow(channels []string, ev Event) {
+	ev, ok := srv.marshal(ev)
+	if !ok {
+		return
+	}
 	srv.pub <- &outbound{
 		channels:       channels,
 		eventOrComment: ev,
+		broadcast:      true,
+		flush:          true,
+	}
+}
+
+// PublishEvent publishes an event to the channels returned by its Channels method, like Publish. If the
+// event does not implement EventWithChannels, it is not published.
+func (srv *Server) PublishEvent(ev Event) {
+	if withChannels, ok := ev.(EventWithChannels); ok {
+		srv.Publish(withChannels.Channels(), ev)
 	}
 }
 
@@ -234,15 +1003,168 @@ func (srv *Server) Publish(channels []string, ev Event) {
 // Close, you can be sure that the event was published before the server was closed.
 func (srv *Server) PublishWithAcknowledgment(channels []string, ev Event) <-chan struct{} {
 	ackCh := make(chan struct{}, 1)
+	ev, ok := srv.marshal(ev)
+	if !ok {
+		ackCh <- struct{}{} // there is nothing for the Server to process
+		return ackCh
+	}
 	srv.pub <- &outbound{
 		channels:       channels,
 		eventOrComment: ev,
+		broadcast:      true,
 		ackCh:          ackCh,
 	}
 	return ackCh
 }
 
+// PublishSync publishes an event to one or more channels, like Publish, and returns once the event has been
+// queued for every current subscriber of those channels. It is the same as reading from the channel returned
+// by PublishWithAcknowledgment, and is mainly useful in tests. It does not wait for the event to be written
+// to the subscribers' connections, let alone read by their clients.
+func (srv *Server) PublishSync(channels []string, ev Event) {
+	<-srv.PublishWithAcknowledgment(channels, ev)
+}
+
+// PublishCount publishes an event to one or more channels, like Publish, and returns the number of
+// subscriptions that it was queued for. This does not include subscriptions whose filters rejected it, or
+// subscribers that were dropped because they had fallen too far behind; and a subscriber whose connection
+// ends before the event is written may still not receive it. A subscription to more than one of the
+// channels is counted once for each.
+func (srv *Server) PublishCount(channels []string, ev Event) int {
+	ev, ok := srv.marshal(ev)
+	if !ok {
+		return 0
+	}
+	countCh := make(chan int, 1)
+	srv.pub <- &outbound{
+		channels:       channels,
+		eventOrComment: ev,
+		broadcast:      true,
+		countCh:        countCh,
+	}
+	return <-countCh
+}
+
+// PublishFromPeer publishes an event that a Broadcaster received from another Server instance to one or more
+// channels, like Publish, except that it does not broadcast the event again, pass it to Marshaler, give it an
+// ID with IDGenerator, or add it to a Repository, since the other Server has already done those things.
+func (srv *Server) PublishFromPeer(channels []string, ev Event) {
+	srv.pub <- &outbound{
+		channels:       channels,
+		eventOrComment: ev,
+		fromPeer:       true,
+	}
+}
+
+// Applies Marshaler to an event, if it is set. Returns false if the event must not be published.
+func (srv *Server) marshal(ev Event) (Event, bool) {
+	if srv.Marshaler == nil {
+		return ev, true
+	}
+	marshaled, err := srv.Marshaler(ev)
+	if err != nil {
+		if srv.OnMarshalError != nil {
+			srv.OnMarshalError(ev, err)
+		} else if srv.Logger != nil {
+			srv.Logger.Println("eventsource: error marshaling event:", err)
+		}
+		return nil, false
+	}
+	return marshaled, true
+}
+
+// Passes an event to the Broadcaster, if there is one, on the background goroutine.
+func (srv *Server) broadcast(channels []string, ev Event) {
+	if srv.Broadcaster == nil {
+		return
+	}
+	queued := srv.runInBackground(func() {
+		defer srv.recoverBackground("broadcasting an event")
+		if err := srv.Broadcaster.Broadcast(channels, ev); err != nil && srv.Logger != nil {
+			srv.Logger.Println("eventsource: error broadcasting event:", err)
+		}
+	})
+	if !queued && srv.Logger != nil {
+		srv.Logger.Println("eventsource: background queue is full; not broadcasting event", ev.Id())
+	}
+}
+
+// PublishToSubscriber publishes an event to a single subscription, identified by the connection ID that
+// was sent to its client in the X-Connection-ID response header; the client can include that ID in its own
+// requests to the application, which can then use it to send a response over the stream. The event is not
+// passed to the subscription's filter, is not assigned an ID by IDGenerator, and is not added to any
+// Repository. If there is no such subscription, the event is discarded.
+func (srv *Server) PublishToSubscriber(connectionID string, ev Event) {
+	ev, ok := srv.marshal(ev)
+	if !ok {
+		return
+	}
+	srv.pub <- &outbound{
+		connectionID:   connectionID,
+		eventOrComment: ev,
+	}
+}
+
+// SwitchChannel moves an active subscription, identified by the connection ID that was sent to its client
+// in the X-Connection-ID response header, to a different channel. From then on, the client receives events
+// published to the new channel instead of the old one, over the same connection; no events are replayed
+// from the new channel's Repository. It returns false if there is no such subscription, or if
+// MaxSubscribersPerChannel or MaxChannels does not allow another subscription to the new channel. It does not
+// call Server.Authorize, so an application that calls it directly must check that the client may subscribe
+// to the new channel.
+//
+// The callbacks for the connection, such as OnDisconnect and ByteCounter, are given the new channel once the
+// handler has written the events that were published to the old channel before the switch.
+func (srv *Server) SwitchChannel(connectionID, channel string) bool {
+	return srv.switchChannel(connectionID, channel) == http.StatusOK
+}
+
+// Returns http.StatusOK if the subscription was moved, http.StatusNotFound if there is no such subscription,
+// or http.StatusServiceUnavailable if the new channel has reached a limit.
+func (srv *Server) switchChannel(connectionID, channel string) int {
+	resultCh := make(chan int, 1)
+	srv.switches <- &channelSwitch{connectionID: connectionID, channel: channel, resultCh: resultCh}
+	return <-resultCh
+}
+
+// SwitchChannelHandler creates an HTTP handler that calls SwitchChannel for the connection ID and channel
+// given in the "connection" and "channel" query parameters. It responds with HTTP 204 on success, 400 if
+// either parameter is missing, 404 if there is no such subscription, or 503 if MaxSubscribersPerChannel or
+// MaxChannels does not allow another subscription to the new channel. If Server.Authorize is set, it is
+// called with the request and the new channel first, and if it returns an error the handler responds in
+// the same way as a channel handler would, without switching.
+//
+// Connection IDs are random and not guessable, but any client that knows one can use this handler to
+// change that connection's channel, so it should be protected in the same way as the channel handlers.
+func (srv *Server) SwitchChannelHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		connectionID, channel := req.URL.Query().Get("connection"), req.URL.Query().Get("channel")
+		if connectionID == "" || channel == "" {
+			http.Error(w, "connection and channel parameters are required", http.StatusBadRequest)
+			return
+		}
+		if srv.Authorize != nil {
+			if err := srv.Authorize(req, channel); err != nil {
+				writeAuthError(w, err)
+				return
+			}
+		}
+		switch status := srv.switchChannel(connectionID, channel); status {
+		case http.StatusOK:
+			w.WriteHeader(http.StatusNoContent)
+		case http.StatusNotFound:
+			http.Error(w, "no such connection", status)
+		default:
+			http.Error(w, http.StatusText(status), status)
+		}
+	}
+}
+
 // PublishComment publishes a comment to one or more channels.
+//
+// Clients ignore comments, but they keep idle connections alive through proxies, and the text is sent
+// verbatim so that monitoring tools can look for it. If the text contains newlines, each line is sent as
+// a separate comment.
 func (srv *Server) PublishComment(channels []string, text string) {
 	srv.pub <- &outbound{
 		channels:       channels,
@@ -250,68 +1172,450 @@ func (srv *Server) PublishComment(channels []string, text string) {
 	}
 }
 
+// PublishError publishes an ErrorEvent with the specified code and message to one or more channels, like
+// Publish.
+func (srv *Server) PublishError(channels []string, code int, message string) {
+	srv.Publish(channels, &ErrorEvent{Code: code, Message: message})
+}
+
 func (srv *Server) run() {
-	// All access to the subs and repos maps is done from the same goroutine, so modifications are safe.
-	subs := make(map[string]map[*subscription]struct{})
-	repos := make(map[string]Repository)
-	trySend := func(sub *subscription, ec eventOrComment) {
-		if !sub.send(ec) {
-			sub.close()
-			delete(subs[sub.channel], sub)
-		}
-	}
+	st := newRunState(srv)
 	for {
 		select {
 		case reg := <-srv.registrations:
-			repos[reg.channel] = reg.repository
+			st.repos[reg.channel] = reg.repository
+			reg.doneCh <- struct{}{} // buffered, like ackCh
 		case unreg := <-srv.unregistrations:
-			delete(repos, unreg.channel)
-			previousSubs := subs[unreg.channel]
-			delete(subs, unreg.channel)
-			if unreg.forceDisconnect {
-				for s := range previousSubs {
-					s.close()
-				}
-			}
+			st.unregister(unreg)
+		case channel := <-srv.channelCloses:
+			st.closeChannel(channel)
 		case sub := <-srv.unsubs:
-			delete(subs[sub.channel], sub)
+			st.removeSub(sub)
+		case resultCh := <-srv.channelLists:
+			resultCh <- st.channels()
+		case query := <-srv.subscriptions:
+			query.resultCh <- st.subscriptionInfos(query.channel)
+		case query := <-srv.lastEventIDs:
+			query.resultCh <- st.lastEventIDs[query.channel]
+		case sw := <-srv.switches:
+			sw.resultCh <- st.switchChannel(sw)
 		case pub := <-srv.pub:
-			for _, c := range pub.channels {
-				for s := range subs[c] {
-					trySend(s, pub.eventOrComment)
-				}
-			}
-			if pub.ackCh != nil {
-				select {
-				// It shouldn't be possible for this channel to block since it is created for a single use, but
-				// we'll do a non-blocking push just to be safe
-				case pub.ackCh <- struct{}{}:
-				default:
-				}
-			}
+			st.publish(pub)
 		case sub := <-srv.subs:
-			if _, ok := subs[sub.channel]; !ok {
-				subs[sub.channel] = make(map[*subscription]struct{})
+			st.subscribe(sub)
+		case <-srv.quit:
+			defer close(srv.done)
+			st.closeAll()
+			close(srv.background) // runBackground() finishes the tasks that are already queued
+			return
+		}
+	}
+}
+
+// Runs the tasks that run() hands off because they can wait for I/O: broadcasting events, adding them to
+// Repositories, and starting replays. They are run one at a time in the order they were queued, so a replay
+// includes every event that was added to the Repository before the subscription.
+func (srv *Server) runBackground() {
+	for task := range srv.background {
+		task()
+	}
+}
+
+// Queues a task for runBackground(). Returns false, without waiting, if backgroundQueueSize tasks are
+// already waiting.
+func (srv *Server) runInBackground(task func()) bool {
+	select {
+	case srv.background <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+// Deferred by background tasks, so that a panic in a Broadcaster or Repository does not stop the Server.
+func (srv *Server) recoverBackground(doing string) {
+	if r := recover(); r != nil && srv.Logger != nil {
+		srv.Logger.Printf("eventsource: panic while %s: %v", doing, r)
+	}
+}
+
+// runState is the state of Server.run(). All access to it is done from that goroutine, so modifications are
+// safe.
+type runState struct {
+	srv          *Server
+	subs         map[string]map[*subscription]struct{}
+	subsByID     map[string]*subscription
+	repos        map[string]Repository
+	lastEventIDs map[string]string
+	lastSeq      uint64
+}
+
+func newRunState(srv *Server) *runState {
+	return &runState{
+		srv:          srv,
+		subs:         make(map[string]map[*subscription]struct{}),
+		subsByID:     make(map[string]*subscription),
+		repos:        make(map[string]Repository),
+		lastEventIDs: make(map[string]string),
+	}
+}
+
+func (st *runState) addSub(sub *subscription) {
+	st.lastSeq++
+	sub.seq = st.lastSeq
+	if _, ok := st.subs[sub.channel]; !ok {
+		st.subs[sub.channel] = make(map[*subscription]struct{})
+	}
+	st.subs[sub.channel][sub] = struct{}{}
+	st.subsByID[sub.id] = sub
+	if st.srv.OnSubscribe != nil {
+		st.srv.OnSubscribe(sub.channel, len(st.subs[sub.channel]))
+	}
+}
+
+func (st *runState) removeSub(sub *subscription) {
+	if _, ok := st.subs[sub.channel][sub]; !ok {
+		return
+	}
+	delete(st.subs[sub.channel], sub)
+	if len(st.subs[sub.channel]) == 0 {
+		delete(st.subs, sub.channel) // so that channels that no longer have subscribers don't use memory
+	}
+	delete(st.subsByID, sub.id)
+	if st.srv.OnUnsubscribe != nil {
+		st.srv.OnUnsubscribe(sub.channel, len(st.subs[sub.channel]))
+	}
+}
+
+// A subscriber that can't keep up is removed right away, rather than by sending it to srv.unsubs, which
+// only this goroutine reads: that could deadlock once the channel's buffer was full.
+func (st *runState) trySend(sub *subscription, ec eventOrComment) bool {
+	if !sub.send(ec) {
+		st.removeSub(sub)
+		return false
+	}
+	return true
+}
+
+// A panic in a subscription's filter or transform function, or in the Repository that replays its missed
+// events, drops that subscription, rather than stopping this goroutine and with it every other subscription.
+func (st *runState) deliverSafely(sub *subscription, deliver func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			if st.srv.Logger != nil {
+				st.srv.Logger.Printf("eventsource: panic while publishing to a subscriber: %v", r)
 			}
-			subs[sub.channel][sub] = struct{}{}
-			if srv.ReplayAll || len(sub.lastEventID) > 0 {
-				repo, ok := repos[sub.channel]
-				if ok {
-					batchCh := repo.Replay(sub.channel, sub.lastEventID)
-					if batchCh != nil {
-						trySend(sub, eventBatch{events: batchCh})
-					}
-				}
+			st.removeSub(sub)
+			sub.close(DisconnectPanic)
+		}
+	}()
+	deliver()
+}
+
+func (st *runState) unregister(unreg *unregistration) {
+	delete(st.repos, unreg.channel)
+	for s := range st.subs[unreg.channel] {
+		st.removeSub(s)
+		if unreg.forceDisconnect {
+			s.close(DisconnectUnregistered)
+		}
+	}
+	delete(st.subs, unreg.channel)
+}
+
+func (st *runState) closeChannel(channel string) {
+	for s := range st.subs[channel] {
+		st.removeSub(s)
+		s.close(DisconnectChannelClosed)
+	}
+	delete(st.subs, channel)
+}
+
+func (st *runState) closeAll() {
+	for _, sub := range st.subs {
+		for s := range sub {
+			st.removeSub(s)
+			s.close(DisconnectServerClosed)
+		}
+	}
+}
+
+// Returns the channels that have a registered Repository, in order.
+func (st *runState) channels() []string {
+	channels := make([]string, 0, len(st.repos))
+	for c := range st.repos {
+		channels = append(channels, c)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+func (st *runState) subscriptionInfos(channel string) []SubscriptionInfo {
+	infos := make([]SubscriptionInfo, 0, len(st.subs[channel]))
+	for s := range st.subs[channel] {
+		infos = append(infos, s.info)
+	}
+	return infos
+}
+
+// Moves a subscription to another channel, and tells its handler. Returns the status for channelSwitch.
+func (st *runState) switchChannel(sw *channelSwitch) int {
+	sub, ok := st.subsByID[sw.connectionID]
+	if !ok {
+		return http.StatusNotFound
+	}
+	if sub.channel == sw.channel {
+		return http.StatusOK
+	}
+	if st.channelFull(sw.channel, sub) {
+		return http.StatusServiceUnavailable
+	}
+	st.removeSub(sub)
+	sub.channel = sw.channel
+	st.addSub(sub)
+	st.trySend(sub, channelSwitched{channel: sw.channel})
+	return http.StatusOK
+}
+
+func (st *runState) publish(pub *outbound) {
+	delivered := 0
+	if pub.connectionID != "" {
+		if s, ok := st.subsByID[pub.connectionID]; ok && st.trySend(s, pub.eventOrComment) {
+			delivered++
+		}
+	}
+	ev, isEvent := pub.eventOrComment.(Event)
+	broadcast := pub.broadcast && st.srv.Broadcaster != nil && isEvent && ev != nil
+	var unchanged []string // the channels to broadcast the event to as it was published, without an ID
+	for _, c := range pub.channels {
+		n, withoutID := st.publishToChannel(pub, c)
+		delivered += n
+		if withoutID && broadcast {
+			unchanged = append(unchanged, c)
+		}
+	}
+	if len(unchanged) > 0 {
+		st.srv.broadcast(unchanged, ev)
+	}
+	if pub.countCh != nil {
+		pub.countCh <- delivered // buffered, like ackCh
+	}
+	if pub.ackCh != nil {
+		select {
+		// It shouldn't be possible for this channel to block since it is created for a single use, but
+		// we'll do a non-blocking push just to be safe
+		case pub.ackCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Publishes an event or comment to one channel's subscriptions, giving an event an ID from IDGenerator first
+// if it needs one, and returns the number of subscriptions it was queued for. The returned bool is true if
+// the event was published as it is, without an ID from IDGenerator.
+func (st *runState) publishToChannel(pub *outbound, c string) (delivered int, withoutID bool) {
+	srv := st.srv
+	ec := pub.eventOrComment
+	ev, isEvent := ec.(Event)
+	if isEvent && srv.IDGenerator != nil && ev.Id() == "" && !resetsID(ev) && !pub.fromPeer {
+		var ok bool
+		if ev, ok = srv.assignID(c, ev, st.repos[c]); !ok {
+			return 0, false
+		}
+		ec = ev
+		if pub.broadcast {
+			srv.broadcast([]string{c}, ev) // so that the peers use the same ID
+		}
+	} else {
+		withoutID = true
+	}
+	if isEvent && (ev.Id() != "" || resetsID(ev)) {
+		st.lastEventIDs[c] = ev.Id()
+	}
+	srv.forEachSub(st.subs[c], func(s *subscription) {
+		st.deliverSafely(s, func() {
+			if st.deliver(s, ec, pub.flush) {
+				delivered++
 			}
-		case <-srv.quit:
-			for _, sub := range subs {
-				for s := range sub {
-					s.close()
+		})
+	})
+	return delivered, withoutID
+}
+
+// Sends an event or comment to a subscription, unless its filter rejects it or its transform function drops
+// it. Returns true if it was queued.
+func (st *runState) deliver(s *subscription, ec eventOrComment, flush bool) bool {
+	ev, isEvent := ec.(Event)
+	if isEvent && !s.accepts(ev) {
+		return false
+	}
+	sent := ec
+	if isEvent && s.transform != nil {
+		bufferLen, bufferCap := s.bufferStats()
+		if sent = s.transform(ev, bufferLen, bufferCap); sent == nil {
+			return false
+		}
+	}
+	if flush {
+		sent = flushNow{value: sent}
+	}
+	return st.trySend(s, sent)
+}
+
+func (st *runState) subscribe(sub *subscription) {
+	if status := st.admissionStatus(sub); status != http.StatusOK {
+		sub.close(DisconnectServerClosed) // not reported, since the handler never starts streaming
+		sub.status <- status
+		return
+	}
+	st.addSub(sub)
+	sub.status <- http.StatusOK
+	st.replay(sub)
+}
+
+// Returns http.StatusOK if a new subscription can be added, or else the status to reject it with.
+func (st *runState) admissionStatus(sub *subscription) int {
+	if st.channelFull(sub.channel, nil) {
+		return http.StatusServiceUnavailable
+	}
+	if _, ok := st.repos[sub.channel]; st.srv.RequireReplay && sub.lastEventID != "" && !ok {
+		return http.StatusNoContent
+	}
+	return http.StatusOK
+}
+
+// Returns true if MaxSubscribersPerChannel or MaxChannels does not allow another subscription to a channel.
+// If the subscription is moving from another channel, leaving is that subscription; its channel no longer
+// counts towards MaxChannels if it is the only subscriber.
+func (st *runState) channelFull(channel string, leaving *subscription) bool {
+	srv := st.srv
+	if srv.MaxSubscribersPerChannel > 0 && len(st.subs[channel]) >= srv.MaxSubscribersPerChannel {
+		return true
+	}
+	if _, ok := st.subs[channel]; ok || srv.MaxChannels <= 0 {
+		return false
+	}
+	channels := len(st.subs)
+	if leaving != nil && len(st.subs[leaving.channel]) == 1 {
+		channels--
+	}
+	return channels >= srv.MaxChannels
+}
+
+// Sends a new subscription the events that its channel's Repository replays, if it asked for them.
+func (st *runState) replay(sub *subscription) {
+	repo, ok := st.repos[sub.channel]
+	if !ok {
+		if st.srv.ReplayAll || len(sub.lastEventID) != 0 {
+			// There is nothing to replay, but the client still needs to be told that the replay is over
+			st.trySend(sub, eventBatch{events: closedEventChannel(), result: &replayResult{}})
+		}
+		return
+	}
+	_, useCursor := repo.(CursorRepository)
+	useCursor = useCursor && sub.cursor != ""
+	if !useCursor && !st.srv.ReplayAll && len(sub.lastEventID) == 0 {
+		return
+	}
+	events := make(chan Event)
+	result := &replayResult{}
+	channel := sub.channel // since run() may switch the subscription's channel meanwhile
+	if !st.srv.runInBackground(func() { st.srv.startReplay(repo, channel, sub, useCursor, events, result) }) {
+		result.incomplete = true // too much is waiting for the background goroutine to wait for the replay
+		close(events)
+	}
+	st.trySend(sub, eventBatch{events: events, result: result})
+}
+
+// Gets the events to replay to a subscription from the Repository, on the background goroutine, and starts
+// forwarding them to events. If the Repository panics, result.panicked is set and events is closed.
+func (srv *Server) startReplay(repo Repository, channel string, sub *subscription, useCursor bool,
+	events chan<- Event, result *replayResult) {
+	var source <-chan Event
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if srv.Logger != nil {
+					srv.Logger.Printf("eventsource: panic while publishing to a subscriber: %v", r)
 				}
+				result.panicked = true
 			}
-			return
+		}()
+		if rc, ok := repo.(RepositoryWithCompleteness); ok && !useCursor {
+			result.incomplete = !rc.HasCompleteHistory(channel, sub.lastEventID)
+		}
+		if useCursor {
+			source = repo.(CursorRepository).ReplayFrom(channel, sub.cursor)
+		} else if rc, ok := repo.(RepositoryWithContext); ok {
+			source = rc.ReplayWithContext(sub.replayCtx, channel, sub.lastEventID)
+		} else {
+			source = repo.Replay(channel, sub.lastEventID)
+		}
+	}()
+	if source == nil { // there is nothing to replay, but the client still needs to be told
+		close(events)
+		return
+	}
+	go func() {
+		defer close(events)
+		for ev := range source {
+			select {
+			case events <- ev:
+			case <-sub.replayCtx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func closedEventChannel() chan Event {
+	ch := make(chan Event)
+	close(ch)
+	return ch
+}
+
+// Gives an event without an ID the next ID from IDGenerator, and adds it to the channel's Repository on the
+// background goroutine if that supports Add. If IDGenerator panics, this logs it and returns false, and the
+// event is not published to the channel.
+func (srv *Server) assignID(channel string, ev Event, repo Repository) (withID Event, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if srv.Logger != nil {
+				srv.Logger.Printf("eventsource: panic while assigning an ID to an event: %v", r)
+			}
+			ok = false
+		}
+	}()
+	withID = &eventWithID{wrapped: ev, id: srv.IDGenerator(channel)}
+	if repo, canAdd := repo.(RepositoryWithAdd); canAdd {
+		queued := srv.runInBackground(func() {
+			defer srv.recoverBackground("adding an event to a repository")
+			repo.Add(channel, withID)
+		})
+		if !queued && srv.Logger != nil {
+			srv.Logger.Println("eventsource: background queue is full; not adding event to repository", withID.Id())
 		}
 	}
+	return withID, true
+}
+
+// Calls fn for each of a channel's subscriptions: in the order they subscribed if OrderedFanOut is set, or
+// else in map order, which is cheaper but unpredictable.
+func (srv *Server) forEachSub(channelSubs map[*subscription]struct{}, fn func(*subscription)) {
+	if !srv.OrderedFanOut {
+		for s := range channelSubs {
+			fn(s)
+		}
+		return
+	}
+	sorted := make([]*subscription, 0, len(channelSubs))
+	for s := range channelSubs {
+		sorted = append(sorted, s)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].seq < sorted[j].seq })
+	for _, s := range sorted {
+		fn(s)
+	}
 }
 
 func (srv *Server) isServerClosed() bool {
@@ -326,15 +1630,30 @@ func (srv *Server) markServerClosed() {
 	srv.isClosed = true
 }
 
+// Returns a random identifier for a subscription, which is unique for all practical purposes.
+func newConnectionID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 // Attempts to send an event or comment to the subscription's channel.
 //
 // We do not want to block the main Server goroutine, so this is a non-blocking send. If it fails,
 // we return false to tell the Server that the subscriber has fallen behind and should be removed;
 // we also immediately close the channel in that case. If the send succeeds-- or if we didn't need
-// to attempt a send, because the channel was already closed-- we return true.
+// to attempt a send, because the channel was already closed-- we return true. If the subscription has a
+// coalescingQueue, the same applies to adding the event to the queue.
 //
 // This should be called only from the Server.run() goroutine.
 func (s *subscription) send(e eventOrComment) bool {
+	if s.queue != nil {
+		if !s.queue.push(e) {
+			s.close(DisconnectSlowConsumer)
+			return false
+		}
+		return true
+	}
 	if s.out == nil {
 		return true
 	}
@@ -342,15 +1661,42 @@ func (s *subscription) send(e eventOrComment) bool {
 	case s.out <- e:
 		return true
 	default:
-		s.close()
+		s.close(DisconnectSlowConsumer)
 		return false
 	}
 }
 
-// Closes a subscription's channel and sets it to nil.
+// Returns the number of events and comments waiting to be sent to the subscriber, and the maximum number.
+func (s *subscription) bufferStats() (int, int) {
+	if s.queue != nil {
+		return s.queue.stats()
+	}
+	return len(s.out), cap(s.out)
+}
+
+// Returns true if the subscription's filter, if any, allows the event to be sent.
+func (s *subscription) accepts(ev Event) bool {
+	return s.filter == nil || s.filter(ev)
+}
+
+// Closes a subscription's channel, recording the reason, and sets it to nil. Has no effect if it was already
+// closed.
 //
 // This should be called only from the Server.run() goroutine.
-func (s *subscription) close() {
+func (s *subscription) close(reason DisconnectReason) {
+	if s.queue != nil { // the queue's pump goroutine closes out once it has sent everything that was queued
+		s.closeReason, s.closedAt = reason, time.Now()
+		close(s.closedCh)
+		s.queue.close()
+		s.queue = nil
+		s.out = nil
+		return
+	}
+	if s.out == nil {
+		return
+	}
+	s.closeReason, s.closedAt = reason, time.Now()
+	close(s.closedCh)
 	close(s.out)
 	s.out = nil
 }
@@ -0,0 +1,191 @@
+package eventsource
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// discardResponseWriter is a minimal streaming ResponseWriter, so that the benchmarks measure the Server
+// and Encoder rather than the network.
+type discardResponseWriter struct {
+	header  http.Header
+	flushes *flushCounter // if not nil, counts the flushes, which is when events reach the client
+	written int64         // the number of events written, each of which the Encoder writes at once
+}
+
+func (w *discardResponseWriter) Header() http.Header { return w.header }
+func (w *discardResponseWriter) WriteHeader(int)     {}
+func (w *discardResponseWriter) Flush() {
+	if w.flushes != nil {
+		w.flushes.flushed(w.written)
+	}
+}
+func (w *discardResponseWriter) Write(data []byte) (int, error) {
+	if bytes.HasSuffix(data, []byte("\n\n")) {
+		w.written++
+	}
+	return len(data), nil
+}
+
+// flushCounter counts a subscriber's flushes, and the events that had been written by the latest one.
+type flushCounter struct {
+	count   int64
+	events  int64
+	flushCh chan struct{}
+}
+
+func newFlushCounter() *flushCounter {
+	return &flushCounter{flushCh: make(chan struct{}, 1)}
+}
+
+func (c *flushCounter) flushed(events int64) {
+	atomic.AddInt64(&c.count, 1)
+	atomic.StoreInt64(&c.events, events)
+	select {
+	case c.flushCh <- struct{}{}:
+	default: // the waiter hasn't yet seen the previous flush, and will check the count then
+	}
+}
+
+// Waits until at least the specified number of events have been flushed.
+func (c *flushCounter) waitForEvents(events int64) {
+	for atomic.LoadInt64(&c.events) < events {
+		<-c.flushCh
+	}
+}
+
+// startBenchmarkSubscribers starts n handlers for the channel and returns a function that stops them.
+func startBenchmarkSubscribers(b *testing.B, server *Server, channel string, n int,
+	flushes *flushCounter) func() {
+	var connected, done sync.WaitGroup
+	connected.Add(n)
+	done.Add(n)
+	server.OnConnect = func(string, string) { connected.Done() }
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := server.Handler(channel)
+	for i := 0; i < n; i++ {
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		go func() {
+			handler.ServeHTTP(&discardResponseWriter{header: make(http.Header), flushes: flushes}, req.WithContext(ctx))
+			done.Done()
+		}()
+	}
+	connected.Wait()
+	server.OnConnect = nil
+	return func() {
+		cancel()
+		done.Wait()
+	}
+}
+
+func BenchmarkServerPublish(b *testing.B) {
+	for _, subscribers := range []int{1, 10, 100} {
+		for _, pubBuffer := range []int{0, 100} {
+			b.Run(fmt.Sprintf("subscribers=%d,pubBuffer=%d", subscribers, pubBuffer), func(b *testing.B) {
+				server := NewServerWithOptions(ServerOptionPublishBufferSize(pubBuffer))
+				server.BufferSize = b.N + 1 // so that no subscriber is dropped for falling behind
+				defer server.Close()
+				stop := startBenchmarkSubscribers(b, server, "test", subscribers, nil)
+				defer stop()
+
+				event := &publication{id: "123", event: "update", data: strings.Repeat("x", 100)}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					server.Publish([]string{"test"}, event)
+				}
+				<-server.PublishWithAcknowledgment([]string{"test"}, event)
+			})
+		}
+	}
+}
+
+// BenchmarkServerFanOutLatency measures how long it takes for a burst of events to be flushed to a
+// subscriber, and how many flushes that takes; FlushInterval trades the first for the second.
+func BenchmarkServerFanOutLatency(b *testing.B) {
+	for _, flushInterval := range []time.Duration{0, time.Millisecond} {
+		for _, burst := range []int{1, 10} {
+			b.Run(fmt.Sprintf("flushInterval=%s,burst=%d", flushInterval, burst), func(b *testing.B) {
+				server := NewServer()
+				server.FlushInterval = flushInterval
+				defer server.Close()
+				flushes := newFlushCounter()
+				stop := startBenchmarkSubscribers(b, server, "test", 1, flushes)
+				defer stop()
+
+				event := &publication{data: "x"}
+				atomic.StoreInt64(&flushes.count, 0) // not counting the flush of the response headers
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					for j := 0; j < burst; j++ {
+						server.Publish([]string{"test"}, event)
+					}
+					flushes.waitForEvents(int64((i + 1) * burst))
+				}
+				b.ReportMetric(float64(atomic.LoadInt64(&flushes.count))/float64(b.N*burst), "flushes/event")
+			})
+		}
+	}
+}
+
+func BenchmarkServerReconnectionStorm(b *testing.B) {
+	server := NewServer()
+	defer server.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stop := startBenchmarkSubscribers(b, server, "test", 100, nil)
+		stop()
+	}
+}
+
+func BenchmarkEncoderGzip(b *testing.B) {
+	event := &publication{id: "123", event: "update", data: strings.Repeat(`{"key":"value"},`, 50)}
+	for _, compressed := range []bool{false, true} {
+		b.Run(fmt.Sprintf("gzip=%t", compressed), func(b *testing.B) {
+			enc := NewEncoder(ioutil.Discard, compressed)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := enc.Encode(event); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// writeCountingWriter counts the writes that reach it, each of which would be a syscall on a network
+// connection.
+type writeCountingWriter struct {
+	writes int
+}
+
+func (w *writeCountingWriter) Write(data []byte) (int, error) {
+	w.writes++
+	return len(data), nil
+}
+
+func BenchmarkEncoderWrites(b *testing.B) {
+	event := &publication{id: "123", event: "update", data: "first line\nsecond line"}
+	w := &writeCountingWriter{}
+	enc := NewEncoder(w, false)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := enc.Encode(event); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+}
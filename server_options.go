@@ -0,0 +1,47 @@
+package eventsource
+
+// ServerOption is a common interface for optional configuration parameters that can be
+// used in creating a Server with NewServerWithOptions.
+//
+// Most Server settings are exported fields that can be changed after the Server is created; options
+// are only used for settings that must be known before the Server starts running.
+type ServerOption interface {
+	apply(srv *Server)
+}
+
+type publishBufferSizeOption struct {
+	size int
+}
+
+func (o publishBufferSizeOption) apply(srv *Server) {
+	srv.pub = make(chan *outbound, o.size)
+}
+
+// ServerOptionPublishBufferSize returns an option that sets how many published events and comments can be
+// queued for the Server's main goroutine before Publish blocks.
+//
+// By default there is no buffer, so each Publish call waits until the previous one has been fanned out to
+// all subscribers. A buffer lets publishers continue while a large fan-out is in progress, at the cost of
+// events being delayed by up to that many queued publications. It does not affect the order of events.
+func ServerOptionPublishBufferSize(size int) ServerOption {
+	return publishBufferSizeOption{size: size}
+}
+
+type backgroundQueueSizeOption struct {
+	size int
+}
+
+func (o backgroundQueueSizeOption) apply(srv *Server) {
+	srv.background = make(chan func(), o.size)
+}
+
+// ServerOptionBackgroundQueueSize returns an option that sets how many tasks can be queued for the Server's
+// background goroutine, which passes events to the Broadcaster, adds the events that IDGenerator gives IDs to
+// the Repository, and starts replays, so that the main goroutine does not wait for them.
+//
+// The default is 1000. While the queue is full, because the Broadcaster or Repository is slow or
+// unreachable, further broadcasts and adds are dropped and logged, and clients that ask for a replay are
+// sent a "_replay_incomplete" event instead, as if the Repository had discarded the events.
+func ServerOptionBackgroundQueueSize(size int) ServerOption {
+	return backgroundQueueSizeOption{size: size}
+}
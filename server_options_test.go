@@ -0,0 +1,85 @@
+package eventsource
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerOptionPublishBufferSize(t *testing.T) {
+	// IDGenerator runs on the Server's main goroutine, so blocking it stalls the fan-out of the first event
+	// and lets us see whether later Publish calls can proceed.
+	publishWhileStalled := func(t *testing.T, server *Server) bool {
+		unblockCh := make(chan struct{})
+		server.IDGenerator = func(string) string {
+			<-unblockCh
+			return "id"
+		}
+		defer server.Close()
+		defer close(unblockCh)
+
+		server.Publish([]string{"test"}, &publication{data: "first"})
+		publishedCh := make(chan struct{})
+		go func() {
+			server.Publish([]string{"test"}, &publication{id: "2", data: "second"})
+			server.Publish([]string{"test"}, &publication{id: "3", data: "third"})
+			close(publishedCh)
+		}()
+		select {
+		case <-publishedCh:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+
+	t.Run("Publish blocks by default", func(t *testing.T) {
+		assert.False(t, publishWhileStalled(t, NewServer()))
+	})
+
+	t.Run("Publish does not block while the buffer has room", func(t *testing.T) {
+		assert.True(t, publishWhileStalled(t, NewServerWithOptions(ServerOptionPublishBufferSize(2))))
+	})
+}
+
+func TestServerQueueStatsReportsPublishBacklog(t *testing.T) {
+	server := NewServerWithOptions(ServerOptionPublishBufferSize(5))
+	defer server.Close()
+	unblockCh := make(chan struct{})
+	server.IDGenerator = func(string) string {
+		<-unblockCh
+		return "id"
+	}
+
+	assert.Equal(t, QueueStat{Len: 0, Cap: 5}, server.QueueStats().Publish)
+
+	// The first event stalls the main goroutine in IDGenerator, so the rest stay queued.
+	server.Publish([]string{"test"}, &publication{})
+	for i := 0; i < 3; i++ {
+		server.Publish([]string{"test"}, &publication{id: "x"})
+	}
+	assert.Eventually(t, func() bool { return server.QueueStats().Publish.Len == 3 }, time.Second, time.Millisecond)
+
+	close(unblockCh)
+	assert.Eventually(t, func() bool { return server.QueueStats().Publish.Len == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, QueueStat{Len: 0, Cap: 2}, server.QueueStats().Unsubscribe)
+}
+
+func TestServerOptionBackgroundQueueSize(t *testing.T) {
+	server := NewServerWithOptions(ServerOptionBackgroundQueueSize(1))
+	defer server.Close()
+	logger := &recordingLogger{}
+	server.Logger = logger
+	broadcaster := &blockingBroadcaster{broadcastingCh: make(chan string, 1), unblockCh: make(chan struct{})}
+	defer close(broadcaster.unblockCh)
+	server.Broadcaster = broadcaster
+
+	server.Publish([]string{"test"}, &publication{id: "1"})
+	assert.Equal(t, "1", <-broadcaster.broadcastingCh)
+	server.Publish([]string{"test"}, &publication{id: "2"}) // waits in the queue
+	<-server.PublishWithAcknowledgment([]string{"test"}, &publication{id: "3"})
+
+	assert.Equal(t, QueueStat{Len: 1, Cap: 1}, server.QueueStats().Background)
+	assert.Equal(t, []string{"eventsource: background queue is full; not broadcasting event 3"}, logger.lines)
+}
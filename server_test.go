@@ -1,13 +1,24 @@
 package eventsource
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -314,3 +325,2776 @@ func TestServerHandlerExitsIfClientClosesConnection(t *testing.T) {
 		require.Fail(t, "timed out waiting for handler to end")
 	}
 }
+
+func TestServerHandlerRefusesNewSubscriptionsWhileDraining(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp1, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp1.Body.Close()
+
+	server.SetDraining(true)
+	assert.True(t, server.IsDraining())
+
+	resp2, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp2.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp2.StatusCode)
+
+	event := &publication{data: "my-event"}
+	<-server.PublishWithAcknowledgment([]string{channel}, event)
+	server.Close()
+
+	body1, err := ioutil.ReadAll(resp1.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: my-event\n\n", string(body1))
+}
+
+func TestServerHandlerWithFilterSkipsRejectedEvents(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.ReplayAll = true
+	server.Register(channel, &testServerRepository{})
+	httpServer := httptest.NewServer(server.HandlerWithFilter(channel, func(ev Event) bool {
+		return ev.Event() != "skip"
+	}))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	server.Publish([]string{channel}, &publication{event: "skip", data: "no"})
+	server.PublishComment([]string{channel}, "comment")
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{event: "keep", data: "yes"})
+	server.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "id: replayed-from-start\ndata: example\n\n:comment\nevent: keep\ndata: yes\n\n", string(body))
+}
+
+type responseWriterWithoutFlush struct {
+	header http.Header
+	status int
+	body   []byte
+}
+
+func (w *responseWriterWithoutFlush) Header() http.Header    { return w.header }
+func (w *responseWriterWithoutFlush) WriteHeader(status int) { w.status = status }
+func (w *responseWriterWithoutFlush) Write(data []byte) (int, error) {
+	w.body = append(w.body, data...)
+	return len(data), nil
+}
+
+func TestServerHandlerReturnsErrorIfResponseWriterCannotFlush(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	w := &responseWriterWithoutFlush{header: make(http.Header)}
+	req, err := http.NewRequest("GET", "/", nil)
+	require.NoError(t, err)
+	server.Handler("test").ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.status)
+	assert.Contains(t, string(w.body), "streaming is not supported")
+}
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Println(args ...interface{}) {
+	l.lines = append(l.lines, strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+}
+
+func (l *recordingLogger) Printf(format string, args ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestServerLogsToCustomLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	server := NewServer()
+	server.Logger = logger
+	defer server.Close()
+
+	w := &responseWriterWithoutFlush{header: make(http.Header)}
+	req, err := http.NewRequest("GET", "/", nil)
+	require.NoError(t, err)
+	server.Handler("test").ServeHTTP(w, req)
+
+	assert.Equal(t, []string{"eventsource: ResponseWriter does not implement http.Flusher, cannot stream"}, logger.lines)
+}
+
+// loggingResponseWriter stands in for logging middleware, whose ResponseWriter hides the original one's Flush
+// method but lets it be found with Unwrap.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	bytes int64
+}
+
+func (w *loggingResponseWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	atomic.AddInt64(&w.bytes, int64(n))
+	return n, err
+}
+
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func TestServerHandlerFindsFlusherBehindMiddleware(t *testing.T) {
+	server := NewServer()
+	connectedCh := make(chan struct{}, 1)
+	server.OnConnect = func(string, string) { connectedCh <- struct{}{} }
+	var logged *loggingResponseWriter
+	loggedCh := make(chan struct{})
+	middleware := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			logged = &loggingResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(logged, req)
+			close(loggedCh)
+		})
+	}
+	httpServer := httptest.NewServer(middleware(server.Handler("test")))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	<-connectedCh
+
+	server.Publish([]string{"test"}, &publication{data: "a"})
+	events, err := ReadEvents(resp.Body, 1) // this would block if the event were not flushed
+	require.NoError(t, err)
+	assert.Equal(t, "a", events[0].Data())
+
+	server.Close()
+	<-loggedCh
+	assert.Equal(t, int64(len("data: a\n\n")), atomic.LoadInt64(&logged.bytes))
+}
+
+func TestServerHandlerSendsConnectionIDHeader(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	connectedCh := make(chan string, 1)
+	server.OnConnect = func(channel, connectionID string) {
+		assert.Equal(t, "test", channel)
+		connectedCh <- connectionID
+	}
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	connectionID := resp.Header.Get("X-Connection-ID")
+	assert.NotEmpty(t, connectionID)
+	select {
+	case id := <-connectedCh:
+		assert.Equal(t, connectionID, id)
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting for OnConnect")
+	}
+}
+
+func TestServerSwitchChannelMovesLiveConnection(t *testing.T) {
+	server := NewServer()
+	disconnectedCh := make(chan string, 1)
+	server.OnDisconnect = func(channel string, _ DisconnectReason) { disconnectedCh <- channel }
+	var countedChannels []string // only appended to by the handler's goroutine
+	server.ByteCounter = func(channel string, _ int) { countedChannels = append(countedChannels, channel) }
+	mux := http.NewServeMux()
+	mux.Handle("/a", server.Handler("a"))
+	mux.Handle("/switch", server.SwitchChannelHandler())
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL + "/a")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	connectionID := resp.Header.Get("X-Connection-ID")
+
+	<-server.PublishWithAcknowledgment([]string{"a"}, &publication{data: "1"})
+
+	switchResp, err := http.Get(httpServer.URL + "/switch?connection=" + connectionID + "&channel=b")
+	require.NoError(t, err)
+	switchResp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, switchResp.StatusCode)
+
+	<-server.PublishWithAcknowledgment([]string{"a"}, &publication{data: "2"})
+	<-server.PublishWithAcknowledgment([]string{"b"}, &publication{data: "3"})
+	server.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: 1\n\ndata: 3\n\n", string(body))
+	assert.Equal(t, "b", <-disconnectedCh)
+	assert.Equal(t, []string{"a", "b"}, countedChannels)
+}
+
+func TestServerSwitchChannelRespectsMaxSubscribersPerChannel(t *testing.T) {
+	server := NewServer()
+	server.MaxSubscribersPerChannel = 1
+	mux := http.NewServeMux()
+	mux.Handle("/a", server.Handler("a"))
+	mux.Handle("/b", server.Handler("b"))
+	mux.Handle("/switch", server.SwitchChannelHandler())
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	respA, err := http.Get(httpServer.URL + "/a")
+	require.NoError(t, err)
+	defer respA.Body.Close()
+	respB, err := http.Get(httpServer.URL + "/b")
+	require.NoError(t, err)
+	defer respB.Body.Close()
+
+	switchResp, err := http.Get(httpServer.URL + "/switch?connection=" + respA.Header.Get("X-Connection-ID") +
+		"&channel=b")
+	require.NoError(t, err)
+	switchResp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, switchResp.StatusCode)
+
+	<-server.PublishWithAcknowledgment([]string{"a"}, &publication{data: "still a"})
+	server.Close()
+
+	body, err := ioutil.ReadAll(respA.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: still a\n\n", string(body))
+}
+
+func TestServerSwitchChannelRespectsMaxChannels(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.MaxChannels = 2
+	mux := http.NewServeMux()
+	mux.Handle("/a", server.Handler("a"))
+	mux.Handle("/b", server.Handler("b"))
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	var connectionIDs []string
+	for _, path := range []string{"/a", "/a", "/b"} {
+		resp, err := http.Get(httpServer.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		connectionIDs = append(connectionIDs, resp.Header.Get("X-Connection-ID"))
+	}
+
+	// A third channel is only allowed if the subscription that moves to it leaves its channel empty.
+	assert.False(t, server.SwitchChannel(connectionIDs[0], "c"))
+	assert.True(t, server.SwitchChannel(connectionIDs[2], "c"))
+}
+
+func TestServerSwitchChannelHandlerCallsAuthorize(t *testing.T) {
+	server := NewServer()
+	server.Authorize = func(req *http.Request, channel string) error {
+		if channel == "secret" {
+			return errors.New("not allowed")
+		}
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/public", server.Handler("public"))
+	mux.Handle("/switch", server.SwitchChannelHandler())
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL + "/public")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	connectionID := resp.Header.Get("X-Connection-ID")
+
+	switchResp, err := http.Get(httpServer.URL + "/switch?connection=" + connectionID + "&channel=secret")
+	require.NoError(t, err)
+	switchResp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, switchResp.StatusCode)
+
+	<-server.PublishWithAcknowledgment([]string{"secret"}, &publication{data: "classified"})
+	<-server.PublishWithAcknowledgment([]string{"public"}, &publication{data: "news"})
+	server.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: news\n\n", string(body))
+}
+
+func TestServerSwitchChannelUnknownConnection(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	httpServer := httptest.NewServer(server.SwitchChannelHandler())
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL + "?connection=unknown&channel=b")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Get(httpServer.URL + "?channel=b")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestServerKeepAliveOnlyWhenIdle(t *testing.T) {
+	server := NewServer()
+	server.KeepAlive = 100 * time.Millisecond
+	mux := http.NewServeMux()
+	mux.Handle("/busy", server.Handler("busy"))
+	mux.Handle("/idle", server.Handler("idle"))
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	busyResp, err := http.Get(httpServer.URL + "/busy")
+	require.NoError(t, err)
+	defer busyResp.Body.Close()
+	idleResp, err := http.Get(httpServer.URL + "/idle")
+	require.NoError(t, err)
+	defer idleResp.Body.Close()
+
+	for i := 0; i < 20; i++ {
+		<-server.PublishWithAcknowledgment([]string{"busy"}, &publication{data: "x"})
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.Close()
+
+	busyBody, err := ioutil.ReadAll(busyResp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("data: x\n\n", 20), string(busyBody))
+
+	idleBody, err := ioutil.ReadAll(idleResp.Body)
+	require.NoError(t, err)
+	assert.NotEmpty(t, idleBody)
+	assert.Equal(t, "", strings.ReplaceAll(string(idleBody), ":\n", ""))
+}
+
+func TestServerHandlerSendsReconnectLink(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.ReconnectLink = "https://stream.example.com/events"
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, `<https://stream.example.com/events>; rel="alternate"`, resp.Header.Get("Link"))
+}
+
+func TestServerHandlerOmitsConnectionHeaderForHTTP2(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	connectedCh := make(chan struct{}, 1)
+	server.OnConnect = func(string, string) { connectedCh <- struct{}{} }
+
+	for _, protoMajor := range []int{1, 2} {
+		t.Run(fmt.Sprintf("HTTP/%d", protoMajor), func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/", nil)
+			require.NoError(t, err)
+			req.ProtoMajor = protoMajor
+			ctx, cancel := context.WithCancel(context.Background())
+			rec := httptest.NewRecorder()
+			doneCh := make(chan struct{})
+			go func() {
+				server.Handler("test").ServeHTTP(rec, req.WithContext(ctx))
+				close(doneCh)
+			}()
+			<-connectedCh
+			cancel()
+			<-doneCh
+			if protoMajor == 1 {
+				assert.Equal(t, "keep-alive", rec.Header().Get("Connection"))
+			} else {
+				assert.NotContains(t, rec.Header(), "Connection")
+			}
+		})
+	}
+}
+
+func TestServerKeepAliveSendsHeartbeatEvent(t *testing.T) {
+	server := NewServer()
+	server.KeepAlive = 20 * time.Millisecond
+	server.HeartbeatEvent = "heartbeat"
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	events, err := ReadEvents(resp.Body, 2)
+	require.NoError(t, err)
+	server.Close()
+
+	for _, ev := range events {
+		assert.Equal(t, "heartbeat", ev.Event())
+		assert.Equal(t, "", ev.Data())
+	}
+}
+
+func TestServerHandlerChecksAllowedOrigins(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.AllowedOrigins = []string{"https://app.example.com"}
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	for _, tc := range []struct {
+		origin      string
+		status      int
+		allowOrigin string
+	}{
+		{"https://app.example.com", http.StatusOK, "https://app.example.com"},
+		{"https://evil.example.com", http.StatusForbidden, ""},
+		{"", http.StatusOK, ""},
+	} {
+		t.Run(fmt.Sprintf("origin %q", tc.origin), func(t *testing.T) {
+			req, _ := http.NewRequest("GET", httpServer.URL, nil)
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tc.status, resp.StatusCode)
+			assert.Equal(t, tc.allowOrigin, resp.Header.Get("Access-Control-Allow-Origin"))
+			if tc.allowOrigin != "" {
+				assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+			}
+		})
+	}
+}
+
+func TestServerHandlerWritesAuthErrorResponse(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.Authorize = func(req *http.Request, channel string) error {
+		if req.Header.Get("Authorization") == "" {
+			return fmt.Errorf("no token: %w", &AuthError{Status: http.StatusUnauthorized,
+				Header: http.Header{"Www-Authenticate": {`Bearer realm="events"`}}})
+		}
+		return &AuthError{} // defaults to 403
+	}
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	req, _ := http.NewRequest("GET", httpServer.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, `Bearer realm="events"`, resp.Header.Get("WWW-Authenticate"))
+
+	req.Header.Set("Authorization", "Bearer expired")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("WWW-Authenticate"))
+}
+
+func TestServerHandlerRespondsToPreflightRequests(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.AllowedOrigins = []string{"https://app.example.com"}
+	server.StrictAccept = true // a preflight request doesn't list text/event-stream
+	subscribed := false
+	server.OnConnect = func(string, string) { subscribed = true }
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	req, _ := http.NewRequest("OPTIONS", httpServer.URL, nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	req.Header.Set("Access-Control-Request-Headers", "authorization")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "GET", resp.Header.Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "authorization", resp.Header.Get("Access-Control-Allow-Headers"))
+
+	req.Header.Set("Origin", "https://evil.example.com")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.False(t, subscribed)
+}
+
+func TestServerHandlerCallsAuthorize(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	subscribedCh := make(chan int, 1)
+	server.OnSubscribe = func(_ string, count int) { subscribedCh <- count }
+	server.Authorize = func(req *http.Request, channel string) error {
+		assert.Equal(t, "test", channel)
+		if req.Header.Get("Authorization") != "Bearer good" {
+			return errors.New("secret reason")
+		}
+		return nil
+	}
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	req, _ := http.NewRequest("GET", httpServer.URL, nil)
+	req.Header.Set("Authorization", "Bearer bad")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.NotContains(t, string(body), "secret reason")
+	assert.NotEqual(t, "text/event-stream; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Len(t, subscribedCh, 0)
+
+	req.Header.Set("Authorization", "Bearer good")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, <-subscribedCh)
+}
+
+type tenantContextKey struct{}
+
+func TestServerHandlerWithMetadataPassesMetadataToFilter(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	defer server.Close()
+	metadata := func(req *http.Request) map[string]string {
+		return map[string]string{"tenant": req.Context().Value(tenantContextKey{}).(string)}
+	}
+	filter := func(ev Event, info SubscriptionInfo) bool {
+		assert.NotEmpty(t, info.ConnectionID)
+		return ev.Event() == info.Metadata["tenant"]
+	}
+	handler := server.HandlerWithMetadata(channel, metadata, filter)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// This stands in for authentication middleware that adds the tenant to the request's context.
+		ctx := context.WithValue(req.Context(), tenantContextKey{}, req.URL.Query().Get("tenant"))
+		handler(w, req.WithContext(ctx))
+	}))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL + "?tenant=a")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, []SubscriptionInfo{{ConnectionID: resp.Header.Get("X-Connection-ID"),
+		Metadata: map[string]string{"tenant": "a"}, Proto: "HTTP/1.1"}}, server.Subscriptions(channel))
+	assert.Empty(t, server.Subscriptions("other"))
+
+	server.Publish([]string{channel}, &publication{event: "b", data: "for b"})
+	server.Publish([]string{channel}, &publication{event: "a", data: "for a"})
+	events, err := ReadEvents(resp.Body, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "for a", events[0].Data())
+}
+
+func TestServerSubscriptionInfoDescribesTransport(t *testing.T) {
+	for _, tc := range []struct {
+		acceptEncoding string
+		encoding       Encoding
+	}{
+		{"identity", EncodingNone},
+		{"gzip", EncodingGzip},
+		{"br", EncodingBrotli},
+	} {
+		t.Run(tc.acceptEncoding, func(t *testing.T) {
+			server := NewServer()
+			defer server.Close()
+			server.Gzip = true
+			server.Brotli = true
+			infoCh := make(chan SubscriptionInfo, 1)
+			filter := func(ev Event, info SubscriptionInfo) bool {
+				infoCh <- info
+				return true
+			}
+			httpServer := httptest.NewServer(server.HandlerWithMetadata("test", nil, filter))
+			defer httpServer.Close()
+
+			req, _ := http.NewRequest("GET", httpServer.URL, nil)
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			server.Publish([]string{"test"}, &publication{data: "a"})
+			info := <-infoCh
+			assert.Equal(t, tc.encoding, info.Encoding)
+			assert.Equal(t, tc.encoding == EncodingGzip, info.Gzip)
+			assert.Equal(t, "HTTP/1.1", info.Proto)
+		})
+	}
+}
+
+func TestServerPublishToSubscriber(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp1, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp1.Body.Close()
+	resp2, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp2.Body.Close()
+
+	server.PublishToSubscriber(resp1.Header.Get("X-Connection-ID"), &publication{data: "just for 1"})
+	server.PublishToSubscriber("unknown", &publication{data: "nobody"})
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "everyone"})
+	server.Close()
+
+	body1, err := ioutil.ReadAll(resp1.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: just for 1\n\ndata: everyone\n\n", string(body1))
+	body2, err := ioutil.ReadAll(resp2.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: everyone\n\n", string(body2))
+}
+
+// evictingRepository has discarded every event up to and including ID "2".
+type evictingRepository struct{}
+
+func (r evictingRepository) Replay(channel, id string) chan Event {
+	out := make(chan Event, 2)
+	for _, eventID := range []string{"3", "4"} {
+		if eventID > id {
+			out <- &publication{id: eventID, data: eventID}
+		}
+	}
+	close(out)
+	return out
+}
+
+func (r evictingRepository) HasCompleteHistory(channel, id string) bool {
+	return id >= "2"
+}
+
+func TestServerSendsReplayIncompleteEventIfRepositoryDiscardedEvents(t *testing.T) {
+	channel := "test"
+	for _, tc := range []struct {
+		lastEventID string
+		expected    string
+	}{
+		{"2", "id: 3\ndata: 3\n\nid: 4\ndata: 4\n\n"},
+		{"1", "id: 3\ndata: 3\n\nid: 4\ndata: 4\n\nevent: _replay_incomplete\ndata: 1\n\n"},
+	} {
+		t.Run("Last-Event-ID "+tc.lastEventID, func(t *testing.T) {
+			server := NewServer()
+			server.Register(channel, evictingRepository{})
+			httpServer := httptest.NewServer(server.Handler(channel))
+			defer httpServer.Close()
+
+			req, _ := http.NewRequest("GET", httpServer.URL, nil)
+			req.Header.Set("Last-Event-ID", tc.lastEventID)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "live"})
+			server.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected+"data: live\n\n", string(body))
+		})
+	}
+}
+
+func TestServerRequireReplayRespondsNoContentWithoutRepository(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.RequireReplay = true
+	server.Register("registered", &testServerRepository{})
+	mux := http.NewServeMux()
+	mux.Handle("/registered", server.Handler("registered"))
+	mux.Handle("/unregistered", server.Handler("unregistered"))
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	get := func(path, lastEventID string) *http.Response {
+		req, _ := http.NewRequest("GET", httpServer.URL+path, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	assert.Equal(t, http.StatusNoContent, get("/unregistered", "1").StatusCode)
+	assert.Equal(t, http.StatusOK, get("/unregistered", "").StatusCode)
+	assert.Equal(t, http.StatusOK, get("/registered", "1").StatusCode)
+}
+
+func TestServerMaxStreamDurationSendsCloseEvent(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	defer server.Close()
+	server.MaxStreamDuration = 100 * time.Millisecond
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "x"})
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: x\n\nevent: close\ndata: \n\n", string(body))
+}
+
+func TestServerStrictAcceptRejectsOtherMediaTypes(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.StrictAccept = true
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	for _, tc := range []struct {
+		accept string
+		status int
+	}{
+		{"text/event-stream", http.StatusOK},
+		{"application/json;q=0.5, Text/Event-Stream;q=0.9", http.StatusOK},
+		{"application/json", http.StatusNotAcceptable},
+		{"*/*", http.StatusNotAcceptable},
+		{"", http.StatusNotAcceptable},
+	} {
+		t.Run(fmt.Sprintf("Accept %q", tc.accept), func(t *testing.T) {
+			req, _ := http.NewRequest("GET", httpServer.URL, nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tc.status, resp.StatusCode)
+		})
+	}
+}
+
+func TestServerHandlerWithInitialEventsSendsThemBeforeReplay(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.ReplayAll = true
+	server.Register(channel, &testServerRepository{})
+	httpServer := httptest.NewServer(server.HandlerWithInitialEvents(channel, func() ([]Event, error) {
+		return []Event{&publication{event: "snapshot", data: "1"}, &publication{event: "snapshot", data: "2"}}, nil
+	}))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "live"})
+	server.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "event: snapshot\ndata: 1\n\nevent: snapshot\ndata: 2\n\n"+
+		"id: replayed-from-start\ndata: example\n\ndata: live\n\n", string(body))
+}
+
+func TestServerHandlerWithInitialEventsLogsErrorAndContinues(t *testing.T) {
+	channel := "test"
+	logger := &recordingLogger{}
+	server := NewServer()
+	server.Logger = logger
+	httpServer := httptest.NewServer(server.HandlerWithInitialEvents(channel, func() ([]Event, error) {
+		return []Event{&publication{data: "partial"}}, errors.New("snapshot failed")
+	}))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "live"})
+	server.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: partial\n\ndata: live\n\n", string(body))
+	assert.Equal(t, []string{"eventsource: error getting initial events: snapshot failed"}, logger.lines)
+}
+
+func TestServerMuxServesRegisteredChannels(t *testing.T) {
+	server := NewServer()
+	server.Register("a", NewSliceRepository())
+	server.Register("b", NewSliceRepository())
+	server.Register("gone", NewSliceRepository())
+	server.Unregister("gone", false)
+	httpServer := httptest.NewServer(server.Mux())
+	defer httpServer.Close()
+
+	respA, err := http.Get(httpServer.URL + "/a")
+	require.NoError(t, err)
+	defer respA.Body.Close()
+	respB, err := http.Get(httpServer.URL + "/b")
+	require.NoError(t, err)
+	defer respB.Body.Close()
+	respGone, err := http.Get(httpServer.URL + "/gone")
+	require.NoError(t, err)
+	respGone.Body.Close()
+	assert.Equal(t, http.StatusNotFound, respGone.StatusCode)
+
+	<-server.PublishWithAcknowledgment([]string{"a"}, &publication{data: "for a"})
+	<-server.PublishWithAcknowledgment([]string{"b"}, &publication{data: "for b"})
+	server.Close()
+
+	bodyA, err := ioutil.ReadAll(respA.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: for a\n\n", string(bodyA))
+	bodyB, err := ioutil.ReadAll(respB.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: for b\n\n", string(bodyB))
+}
+
+func TestChannelHandlerAppliesFilter(t *testing.T) {
+	server := NewServer()
+	httpServer := httptest.NewServer(&ChannelHandler{Server: server, Channel: "test",
+		Filter: func(ev Event) bool { return ev.Data() != "skip" }})
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	server.Publish([]string{"test"}, &publication{data: "skip"})
+	<-server.PublishWithAcknowledgment([]string{"test"}, &publication{data: "keep"})
+	server.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: keep\n\n", string(body))
+}
+
+func TestServerSendsInitialPadding(t *testing.T) {
+	for _, tc := range []struct {
+		size     int
+		expected string
+	}{
+		{0, ":ok\n"},
+		{10, ":ok      \n"},
+		{2048, ":ok" + strings.Repeat(" ", 2044) + "\n"},
+	} {
+		t.Run(fmt.Sprintf("size %d", tc.size), func(t *testing.T) {
+			server := NewServer()
+			server.SendInitialPadding = true
+			server.InitialPaddingSize = tc.size
+			httpServer := httptest.NewServer(server.Handler("test"))
+			defer httpServer.Close()
+
+			resp, err := http.Get(httpServer.URL)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			server.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, string(body))
+			assert.GreaterOrEqual(t, len(body), tc.size)
+		})
+	}
+}
+
+func TestServerValidateLastEventID(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	defer server.Close()
+	server.Register(channel, &testServerRepository{})
+	server.ValidateLastEventID = func(c, id string) (string, error) {
+		assert.Equal(t, channel, c)
+		n, err := strconv.Atoi(id)
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("invalid event ID %q", id)
+		}
+		return strconv.Itoa(n), nil
+	}
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	get := func(lastEventID string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", httpServer.URL, nil)
+		req.Header.Set("Last-Event-ID", lastEventID)
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		return resp, line
+	}
+
+	resp, line := get("007")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "id: replayed-from-7\n", line)
+
+	resp, line = get("garbage")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "invalid event ID \"garbage\"\n", line)
+}
+
+func TestServerCloseChannelDisconnectsOnlyThatChannel(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.Register("closed", NewSliceRepository())
+	mux := http.NewServeMux()
+	mux.Handle("/closed", server.Handler("closed"))
+	mux.Handle("/open", server.Handler("open"))
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	respClosed, err := http.Get(httpServer.URL + "/closed")
+	require.NoError(t, err)
+	defer respClosed.Body.Close()
+	respOpen, err := http.Get(httpServer.URL + "/open")
+	require.NoError(t, err)
+	defer respOpen.Body.Close()
+
+	server.CloseChannel("closed")
+	body, err := ioutil.ReadAll(respClosed.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "", string(body))
+
+	server.Publish([]string{"open"}, &publication{data: "still here"})
+	line, err := bufio.NewReader(respOpen.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: still here\n", line)
+
+	// The channel can still be subscribed to, and is still registered
+	respAgain, err := http.Get(httpServer.URL + "/closed")
+	require.NoError(t, err)
+	defer respAgain.Body.Close()
+	assert.Equal(t, http.StatusOK, respAgain.StatusCode)
+	resultCh := make(chan []string, 1)
+	server.channelLists <- resultCh
+	assert.Equal(t, []string{"closed"}, <-resultCh)
+}
+
+// endlessRepository replays events until its context is cancelled.
+type endlessRepository struct {
+	cancelledCh chan struct{}
+}
+
+func (r *endlessRepository) Replay(channel, id string) chan Event {
+	panic("ReplayWithContext should have been called instead")
+}
+
+func (r *endlessRepository) ReplayWithContext(ctx context.Context, channel, id string) chan Event {
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case out <- &publication{data: "replayed"}:
+			case <-ctx.Done():
+				close(r.cancelledCh)
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func TestServerCancelsReplayWhenClientDisconnects(t *testing.T) {
+	channel := "test"
+	repo := &endlessRepository{cancelledCh: make(chan struct{})}
+	server := NewServer()
+	defer server.Close()
+	server.ReplayAll = true
+	server.Register(channel, repo)
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: replayed\n", line)
+	resp.Body.Close()
+
+	select {
+	case <-repo.cancelledCh:
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting for replay to be cancelled")
+	}
+}
+
+func TestServerReleasesSliceRepositoryWhenClientDisconnectsDuringReplay(t *testing.T) {
+	channel := "test"
+	repo := NewSliceRepository()
+	for i := 0; i < 1000; i++ {
+		repo.Add(channel, &publication{id: fmt.Sprintf("%04d", i), data: strings.Repeat("x", 1000)})
+	}
+	server := NewServer()
+	defer server.Close()
+	server.ReplayAll = true
+	server.Register(channel, repo)
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	_, err = bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// The replay must not keep Add waiting, whether or not it has stopped
+	addedCh := make(chan struct{})
+	go func() {
+		repo.Add(channel, &publication{id: "1000"})
+		close(addedCh)
+	}()
+	select {
+	case <-addedCh:
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting for replay to release the repository")
+	}
+}
+
+func TestServerPublishCountReturnsNumberOfSubscriptions(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	mux := http.NewServeMux()
+	mux.Handle("/a", server.Handler("a"))
+	mux.Handle("/b", server.HandlerWithFilter("b", func(ev Event) bool { return ev.Event() != "skip" }))
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	for _, path := range []string{"/a", "/a", "/b"} {
+		resp, err := http.Get(httpServer.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+	}
+
+	assert.Equal(t, 3, server.PublishCount([]string{"a", "b"}, &publication{data: "x"}))
+	assert.Equal(t, 2, server.PublishCount([]string{"a", "b"}, &publication{event: "skip"}))
+	assert.Equal(t, 1, server.PublishCount([]string{"b"}, &publication{data: "x"}))
+	assert.Equal(t, 0, server.PublishCount([]string{"none"}, &publication{data: "x"}))
+}
+
+func TestServerPublishIgnoresNilEvent(t *testing.T) {
+	for _, withBroadcaster := range []bool{false, true} {
+		server := NewServer()
+		if withBroadcaster {
+			server.Broadcaster = NewRedisBroadcaster(&fakeRedisPubSub{t: t}, "events")
+		}
+		server.Publish([]string{"test"}, nil)
+		// The Server is still running if it can answer another publication.
+		assert.Equal(t, 0, server.PublishCount([]string{"test"}, &publication{data: "x"}))
+		server.Close()
+	}
+}
+
+// blockingBroadcaster's Broadcast signals broadcastingCh with the event's ID, and then waits for unblockCh.
+type blockingBroadcaster struct {
+	broadcastingCh chan string
+	unblockCh      chan struct{}
+}
+
+func (b *blockingBroadcaster) Broadcast(channels []string, ev Event) error {
+	b.broadcastingCh <- ev.Id()
+	<-b.unblockCh
+	return nil
+}
+
+func TestServerPublishDoesNotWaitForBroadcaster(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	defer server.Close()
+	broadcaster := &blockingBroadcaster{broadcastingCh: make(chan string, 2), unblockCh: make(chan struct{})}
+	defer close(broadcaster.unblockCh)
+	server.Broadcaster = broadcaster
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+	client := &http.Client{Timeout: time.Second}
+	resp, err := client.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	server.Publish([]string{channel}, &publication{id: "1", data: "a"})
+	assert.Equal(t, "1", <-broadcaster.broadcastingCh)
+	server.Publish([]string{channel}, &publication{id: "2", data: "b"}) // while the first is still broadcasting
+
+	events, err := ReadEvents(resp.Body, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "2", events[1].Id())
+}
+
+// slowAddRepository is a SliceRepository whose Add takes a while, like a Repository on a remote server.
+type slowAddRepository struct {
+	*SliceRepository
+}
+
+func (r slowAddRepository) Add(channel string, ev Event) {
+	time.Sleep(50 * time.Millisecond)
+	r.SliceRepository.Add(channel, ev)
+}
+
+func TestServerReplaysEventsThatAreStillBeingAdded(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	defer server.Close()
+	server.ReplayAll = true
+	server.Register(channel, slowAddRepository{NewSliceRepository()})
+	nextID := 0
+	server.IDGenerator = func(string) string {
+		nextID++
+		return strconv.Itoa(nextID)
+	}
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "a"})
+	client := &http.Client{Timeout: time.Second}
+	resp, err := client.Get(httpServer.URL) // before the event has been added to the Repository
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	server.Publish([]string{channel}, &publication{data: "b"})
+
+	events, err := ReadEvents(resp.Body, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "2"}, []string{events[0].Id(), events[1].Id()})
+}
+
+func TestServerSendsRetryWithJitter(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.RetryBase = time.Second
+	server.RetryJitter = 500 * time.Millisecond
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	for i := 0; i < 5; i++ {
+		resp, err := http.Get(httpServer.URL)
+		require.NoError(t, err)
+		line, err := bufio.NewReader(resp.Body).ReadString('\n')
+		resp.Body.Close()
+		require.NoError(t, err)
+
+		var millis int
+		_, err = fmt.Sscanf(line, "retry: %d\n", &millis)
+		require.NoError(t, err, "unexpected line %q", line)
+		assert.GreaterOrEqual(t, millis, 1000)
+		assert.Less(t, millis, 1500)
+	}
+}
+
+func TestServerRegisterAppliesBeforeReturning(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	// A client that subscribed before the channel had a Repository gets no replay...
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	server.Publish([]string{"test"}, &publication{id: "0", data: "zeroth"})
+	events, err := ReadEvents(resp.Body, 1)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// ...but once Register has returned, its reconnection does.
+	repo := NewSliceRepository()
+	repo.Add("test", &publication{id: "1", data: "first"})
+	repo.Add("test", &publication{id: "2", data: "second"})
+	server.Register("test", repo)
+
+	req, _ := http.NewRequest("GET", httpServer.URL, nil)
+	req.Header.Set("Last-Event-ID", events[0].Id())
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	events, err = ReadEvents(resp.Body, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "first", events[0].Data())
+	assert.Equal(t, "second", events[1].Data())
+}
+
+type eventWithChannels struct {
+	publication
+	channels []string
+}
+
+func (e *eventWithChannels) Channels() []string { return e.channels }
+
+func TestServerPublishEventUsesEventsOwnChannels(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	server.PublishEvent(&eventWithChannels{publication{id: "1", data: "x"}, []string{"a", "b"}})
+	server.PublishEvent(&publication{id: "2", data: "no channels"})
+	assert.Equal(t, "1", server.LastEventID("a"))
+	assert.Equal(t, "1", server.LastEventID("b"))
+	assert.Equal(t, "", server.LastEventID("c"))
+}
+
+func TestServerLastEventIDReportsMostRecentIDPerChannel(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	assert.Equal(t, "", server.LastEventID("a"))
+
+	server.Publish([]string{"a", "b"}, &publication{id: "1", data: "x"})
+	server.Publish([]string{"a"}, &publication{id: "2", data: "y"})
+	server.Publish([]string{"a"}, &publication{data: "no ID"})
+	server.PublishComment([]string{"a"}, "comment")
+	assert.Equal(t, "2", server.LastEventID("a"))
+	assert.Equal(t, "1", server.LastEventID("b"))
+	assert.Equal(t, "", server.LastEventID("c"))
+
+	server.Publish([]string{"a"}, &eventWithIDReset{publication{data: "reset"}})
+	assert.Equal(t, "", server.LastEventID("a"))
+}
+
+func TestServerIDGeneratorAssignsIDsToEventsWithoutThem(t *testing.T) {
+	channel := "test"
+	repo := NewSliceRepository()
+	server := NewServer()
+	nextID := 0
+	server.IDGenerator = func(c string) string {
+		assert.Equal(t, channel, c)
+		nextID++
+		return fmt.Sprintf("%03d", nextID)
+	}
+	server.Register(channel, repo)
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	server.Publish([]string{channel}, &publication{data: "a"})
+	server.Publish([]string{channel}, &publication{id: "explicit", data: "b"})
+	<-server.PublishWithAcknowledgment([]string{channel},
+		&eventWithComments{publication: publication{data: "c"}, comments: []string{"note"}})
+	assert.Equal(t, "002", server.LastEventID(channel))
+	server.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "id: 001\ndata: a\n\nid: explicit\ndata: b\n\n:note\nid: 002\ndata: c\n\n", string(body))
+
+	var replayed []string
+	for ev := range repo.Replay(channel, "") {
+		replayed = append(replayed, ev.Id()+"="+ev.Data())
+	}
+	assert.Equal(t, []string{"001=a", "002=c"}, replayed)
+}
+
+func TestServerHandlerFiltersEventTypesRequestedByClient(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.EventTypesParam = "type"
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	respA, err := http.Get(httpServer.URL + "?type=a")
+	require.NoError(t, err)
+	defer respA.Body.Close()
+	respAll, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer respAll.Body.Close()
+
+	server.Publish([]string{channel}, &publication{event: "a", data: "1"})
+	server.Publish([]string{channel}, &publication{event: "b", data: "2"})
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{event: "a", data: "3"})
+	server.Close()
+
+	bodyA, err := ioutil.ReadAll(respA.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "event: a\ndata: 1\n\nevent: a\ndata: 3\n\n", string(bodyA))
+	bodyAll, err := ioutil.ReadAll(respAll.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "event: a\ndata: 1\n\nevent: b\ndata: 2\n\nevent: a\ndata: 3\n\n", string(bodyAll))
+}
+
+type flushCountingRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (r *flushCountingRecorder) Flush() {
+	r.flushes++
+	r.ResponseRecorder.Flush()
+}
+
+type priceChange struct {
+	publication
+	price float64
+}
+
+func TestServerPublishesEventsFromMarshaler(t *testing.T) {
+	server := NewServer()
+	server.Marshaler = func(ev Event) (Event, error) {
+		change, ok := ev.(*priceChange)
+		if !ok {
+			return nil, errors.New("unknown event")
+		}
+		return &publication{event: "priceChange", data: fmt.Sprintf(`{"price":%.2f}`, change.price)}, nil
+	}
+	var marshalErrors []string
+	server.OnMarshalError = func(ev Event, err error) { marshalErrors = append(marshalErrors, ev.Data()+": "+err.Error()) }
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, 1, server.PublishCount([]string{"test"}, &priceChange{price: 1.5}))
+	assert.Equal(t, 0, server.PublishCount([]string{"test"}, &publication{data: "raw"}))
+	server.PublishSync([]string{"test"}, &priceChange{price: 2})
+	server.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "event: priceChange\ndata: {\"price\":1.50}\n\nevent: priceChange\ndata: {\"price\":2.00}\n\n",
+		string(body))
+	assert.Equal(t, []string{"raw: unknown event"}, marshalErrors)
+}
+
+func TestServerPublishError(t *testing.T) {
+	server := NewServer()
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	server.PublishError([]string{"test"}, 503, "feed \"prices\" is unavailable")
+	<-server.PublishWithAcknowledgment([]string{"test"}, &publication{data: "a"})
+	server.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "event: error\ndata: {\"code\":503,\"message\":\"feed \\\"prices\\\" is unavailable\"}\n\ndata: a\n\n",
+		string(body))
+}
+
+func TestServerReportsBytesSentToByteCounter(t *testing.T) {
+	for _, gzip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("gzip=%t", gzip), func(t *testing.T) {
+			server := NewServer()
+			server.Gzip = gzip
+			var lock sync.Mutex
+			counts := make(map[string]int)
+			server.ByteCounter = func(channel string, n int) {
+				lock.Lock()
+				counts[channel] += n
+				lock.Unlock()
+			}
+			httpServer := httptest.NewServer(server.Handler("test"))
+			defer httpServer.Close()
+
+			req, _ := http.NewRequest("GET", httpServer.URL, nil)
+			req.Header.Set("Accept-Encoding", "gzip") // so that the client doesn't decompress the body
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			server.PublishSync([]string{"test"}, &publication{data: "aaa"})
+			server.PublishSync([]string{"test"}, &publication{id: "1", data: "bbb"})
+			server.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			lock.Lock()
+			defer lock.Unlock()
+			assert.Equal(t, map[string]int{"test": len(body)}, counts)
+		})
+	}
+}
+
+func TestServerPublishSyncReturnsOnceEventIsQueued(t *testing.T) {
+	server := NewServer()
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	server.PublishSync([]string{"test"}, &publication{data: "a"})
+	server.PublishSync([]string{"test"}, &publication{data: "b"})
+	server.Close() // would otherwise be able to disconnect the subscriber before the events were queued
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: a\n\ndata: b\n\n", string(body))
+}
+
+func TestServerHandlerFlushInterval(t *testing.T) {
+	doTest := func(t *testing.T, flushInterval time.Duration) *flushCountingRecorder {
+		channel := "test"
+		server := NewServer()
+		server.FlushInterval = flushInterval
+		defer server.Close()
+
+		connectedCh := make(chan struct{}, 1)
+		server.OnConnect = func(string, string) { connectedCh <- struct{}{} }
+		rec := &flushCountingRecorder{ResponseRecorder: httptest.NewRecorder()}
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequest("GET", "/", nil)
+		require.NoError(t, err)
+		doneCh := make(chan struct{})
+		go func() {
+			server.Handler(channel).ServeHTTP(rec, req.WithContext(ctx))
+			close(doneCh)
+		}()
+		<-connectedCh
+
+		for i := 0; i < 10; i++ {
+			<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "x"})
+		}
+		time.Sleep(flushInterval + 100*time.Millisecond)
+		cancel()
+		<-doneCh
+		assert.Equal(t, strings.Repeat("data: x\n\n", 10), rec.Body.String())
+		return rec
+	}
+
+	t.Run("flushes after each event by default", func(t *testing.T) {
+		rec := doTest(t, 0)
+		assert.Equal(t, 11, rec.flushes) // one after the headers, then one per event
+	})
+
+	t.Run("batches flushes if FlushInterval is set", func(t *testing.T) {
+		rec := doTest(t, 200*time.Millisecond)
+		assert.LessOrEqual(t, rec.flushes, 3)
+		assert.GreaterOrEqual(t, rec.flushes, 2)
+	})
+}
+
+func TestServerPublishNowFlushesDespiteFlushInterval(t *testing.T) {
+	server := NewServer()
+	server.FlushInterval = time.Hour
+	defer server.Close()
+	connectedCh := make(chan struct{}, 1)
+	server.OnConnect = func(string, string) { connectedCh <- struct{}{} }
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	<-connectedCh
+
+	server.Publish([]string{"test"}, &publication{data: "waiting"})
+	server.PublishNow([]string{"test"}, &publication{data: "urgent"})
+
+	eventsCh := make(chan string, 2)
+	go func() {
+		dec := NewDecoder(resp.Body)
+		for {
+			ev, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			eventsCh <- ev.Data()
+		}
+	}()
+	for _, expected := range []string{"waiting", "urgent"} {
+		select {
+		case data := <-eventsCh:
+			assert.Equal(t, expected, data)
+		case <-time.After(time.Second):
+			require.Fail(t, "timed out waiting for "+expected)
+		}
+	}
+}
+
+func TestServerReportsSubscriberCounts(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	countsCh := make(chan string, 10)
+	server.OnSubscribe = func(channel string, count int) { countsCh <- fmt.Sprintf("+%s:%d", channel, count) }
+	server.OnUnsubscribe = func(channel string, count int) { countsCh <- fmt.Sprintf("-%s:%d", channel, count) }
+	httpServer := httptest.NewServer(server.Handler("test"))
+	defer httpServer.Close()
+
+	expectCount := func(expected string) {
+		select {
+		case c := <-countsCh:
+			assert.Equal(t, expected, c)
+		case <-time.After(time.Second):
+			assert.Fail(t, "timed out waiting for "+expected)
+		}
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	req1, _ := http.NewRequest("GET", httpServer.URL, nil)
+	resp1, err := http.DefaultClient.Do(req1.WithContext(ctx1))
+	require.NoError(t, err)
+	defer resp1.Body.Close()
+	expectCount("+test:1")
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	req2, _ := http.NewRequest("GET", httpServer.URL, nil)
+	resp2, err := http.DefaultClient.Do(req2.WithContext(ctx2))
+	require.NoError(t, err)
+	defer resp2.Body.Close()
+	expectCount("+test:2")
+
+	cancel1()
+	expectCount("-test:1")
+	cancel2()
+	expectCount("-test:0")
+}
+
+type blockingResponseWriter struct {
+	*httptest.ResponseRecorder
+	writingCh chan struct{}
+	unblockCh chan struct{}
+	err       error // if set, writes fail with this error once unblocked
+}
+
+func (w *blockingResponseWriter) Write(data []byte) (int, error) {
+	select {
+	case w.writingCh <- struct{}{}:
+	default:
+	}
+	<-w.unblockCh
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.ResponseRecorder.Write(data)
+}
+
+func (w *blockingResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func TestServerDropsSubscriberThatFallsBehind(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	defer server.Close()
+	server.BufferSize = 1
+	connectedCh := make(chan struct{}, 1)
+	server.OnConnect = func(string, string) { connectedCh <- struct{}{} }
+	unsubscribedCh := make(chan int, 1)
+	server.OnUnsubscribe = func(_ string, count int) { unsubscribedCh <- count }
+	reasonCh := make(chan DisconnectReason, 1)
+	server.OnDisconnect = func(_ string, reason DisconnectReason) { reasonCh <- reason }
+
+	w := &blockingResponseWriter{ResponseRecorder: httptest.NewRecorder(),
+		writingCh: make(chan struct{}, 1), unblockCh: make(chan struct{})}
+	req, _ := http.NewRequest("GET", "/", nil)
+	doneCh := make(chan struct{})
+	go func() {
+		server.Handler(channel).ServeHTTP(w, req)
+		close(doneCh)
+	}()
+	<-connectedCh
+
+	// The handler blocks writing the first event, the second fills the buffer, and the third can't be queued.
+	server.Publish([]string{channel}, &publication{data: "x"})
+	<-w.writingCh
+	for i := 0; i < 2; i++ {
+		<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "x"})
+	}
+	select {
+	case count := <-unsubscribedCh:
+		assert.Equal(t, 0, count)
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting for subscriber to be dropped")
+	}
+
+	close(w.unblockCh)
+	<-doneCh
+	assert.Equal(t, "data: x\n\ndata: x\n\n", w.Body.String())
+	assert.Equal(t, DisconnectSlowConsumer, <-reasonCh)
+}
+
+func TestServerHandlerWithTransformSeesBufferDepth(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.BufferSize = 4
+	connectedCh := make(chan struct{}, 1)
+	server.OnConnect = func(string, string) { connectedCh <- struct{}{} }
+	var bufferLens []int
+	transform := func(ev Event, bufferLen, bufferCap int) Event {
+		assert.Equal(t, 4, bufferCap)
+		bufferLens = append(bufferLens, bufferLen)
+		if ev.Data() == "drop" {
+			return nil
+		}
+		if bufferLen*2 >= bufferCap {
+			return &publication{data: "thumbnail"}
+		}
+		return ev
+	}
+
+	w := &blockingResponseWriter{ResponseRecorder: httptest.NewRecorder(),
+		writingCh: make(chan struct{}, 1), unblockCh: make(chan struct{})}
+	req, _ := http.NewRequest("GET", "/", nil)
+	doneCh := make(chan struct{})
+	go func() {
+		server.HandlerWithTransform(channel, transform).ServeHTTP(w, req)
+		close(doneCh)
+	}()
+	<-connectedCh
+
+	// The handler blocks writing the first event, so the others wait in its buffer.
+	server.Publish([]string{channel}, &publication{data: "full 1"})
+	<-w.writingCh
+	for _, data := range []string{"full 2", "full 3", "full 4", "drop"} {
+		<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: data})
+	}
+	server.PublishComment([]string{channel}, "comments are not transformed")
+	server.Close()
+	close(w.unblockCh)
+	<-doneCh
+
+	assert.Equal(t, []int{0, 0, 1, 2, 3}, bufferLens)
+	assert.Equal(t, "data: full 1\n\ndata: full 2\n\ndata: full 3\n\ndata: thumbnail\n\n:comments are not transformed\n",
+		w.Body.String())
+}
+
+func TestServerDrainTimeoutLimitsWritingBufferedEventsAfterClose(t *testing.T) {
+	for _, drainTimeout := range []time.Duration{0, 50 * time.Millisecond} {
+		t.Run(fmt.Sprintf("DrainTimeout %s", drainTimeout), func(t *testing.T) {
+			channel := "test"
+			server := NewServer()
+			defer server.Close()
+			server.DrainTimeout = drainTimeout
+			connectedCh := make(chan struct{}, 1)
+			server.OnConnect = func(string, string) { connectedCh <- struct{}{} }
+			undeliveredCh := make(chan string, 10)
+			server.OnUndelivered = func(_ string, ev Event) { undeliveredCh <- ev.Data() }
+			reasonCh := make(chan DisconnectReason, 1)
+			server.OnDisconnect = func(_ string, reason DisconnectReason) { reasonCh <- reason }
+
+			w := &blockingResponseWriter{ResponseRecorder: httptest.NewRecorder(),
+				writingCh: make(chan struct{}, 1), unblockCh: make(chan struct{})}
+			req, _ := http.NewRequest("GET", "/", nil)
+			doneCh := make(chan struct{})
+			go func() {
+				server.Handler(channel).ServeHTTP(w, req)
+				close(doneCh)
+			}()
+			<-connectedCh
+
+			// The handler blocks writing the first event while the others are buffered and the channel is closed.
+			server.Publish([]string{channel}, &publication{data: "a"})
+			<-w.writingCh
+			for _, data := range []string{"b", "c"} {
+				server.Publish([]string{channel}, &publication{data: data})
+			}
+			server.CloseChannel(channel)
+			if drainTimeout > 0 {
+				time.Sleep(drainTimeout * 2)
+			}
+			close(w.unblockCh)
+			<-doneCh
+
+			assert.Equal(t, DisconnectChannelClosed, <-reasonCh)
+			if drainTimeout == 0 {
+				assert.Equal(t, "data: a\n\ndata: b\n\ndata: c\n\n", w.Body.String())
+				assert.Len(t, undeliveredCh, 0)
+			} else {
+				// The blocked write finishes, but the handler stops before writing the buffered events.
+				assert.Equal(t, "data: a\n\n", w.Body.String())
+				require.Len(t, undeliveredCh, 2)
+				assert.Equal(t, "b", <-undeliveredCh)
+				assert.Equal(t, "c", <-undeliveredCh)
+			}
+		})
+	}
+}
+
+func TestServerWriteTimeoutDisconnectsClientThatStopsReading(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	defer server.Close()
+	server.BufferSize = 1000
+	server.WriteTimeout = 100 * time.Millisecond
+	connectedCh := make(chan struct{}, 1)
+	server.OnConnect = func(string, string) { connectedCh <- struct{}{} }
+	reasonCh := make(chan DisconnectReason, 1)
+	server.OnDisconnect = func(_ string, reason DisconnectReason) { reasonCh <- reason }
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	// This client sends a request but never reads the response.
+	conn, err := net.Dial("tcp", httpServer.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-connectedCh
+
+	bigEvent := &publication{data: strings.Repeat("x", 64*1024)}
+	deadline := time.After(5 * time.Second)
+	for {
+		server.Publish([]string{channel}, bigEvent)
+		select {
+		case reason := <-reasonCh:
+			assert.Equal(t, DisconnectWriteError, reason)
+			return
+		case <-deadline:
+			assert.Fail(t, "timed out waiting for stuck client to be disconnected")
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestServerDrainTimeoutDisconnectsClientThatStopsReading(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	defer server.Close()
+	server.BufferSize = 1000
+	server.DrainTimeout = 100 * time.Millisecond
+	connectedCh := make(chan struct{}, 1)
+	server.OnConnect = func(string, string) { connectedCh <- struct{}{} }
+	reasonCh := make(chan DisconnectReason, 1)
+	server.OnDisconnect = func(_ string, reason DisconnectReason) { reasonCh <- reason }
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	// This client sends a request but never reads the response, so the handler blocks in a write.
+	conn, err := net.Dial("tcp", httpServer.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	<-connectedCh
+	bigEvent := &publication{data: strings.Repeat("x", 64*1024)}
+	for i := 0; i < 500; i++ {
+		server.Publish([]string{channel}, bigEvent)
+	}
+
+	server.CloseChannel(channel)
+	select {
+	case reason := <-reasonCh:
+		assert.Equal(t, DisconnectChannelClosed, reason)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "timed out waiting for stuck client to be disconnected")
+	}
+}
+
+func TestServerCoalescesEventsForSubscriberThatFallsBehind(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.BufferSize = 3
+	server.Coalesce = true
+	connectedCh := make(chan struct{}, 1)
+	server.OnConnect = func(string, string) { connectedCh <- struct{}{} }
+	unsubscribedCh := make(chan int, 1)
+	server.OnUnsubscribe = func(_ string, count int) { unsubscribedCh <- count }
+
+	w := &blockingResponseWriter{ResponseRecorder: httptest.NewRecorder(),
+		writingCh: make(chan struct{}, 1), unblockCh: make(chan struct{})}
+	req, _ := http.NewRequest("GET", "/", nil)
+	doneCh := make(chan struct{})
+	go func() {
+		server.Handler(channel).ServeHTTP(w, req)
+		close(doneCh)
+	}()
+	<-connectedCh
+
+	// Events without a type are never coalesced; of the rest, only the latest of each type is kept.
+	server.Publish([]string{channel}, &publication{data: "a"})
+	<-w.writingCh
+	server.Publish([]string{channel}, &publication{data: "b"})
+	for i := 1; i < 10; i++ {
+		server.Publish([]string{channel}, &publication{event: "state", data: fmt.Sprint(i)})
+	}
+	server.Publish([]string{channel}, &publication{event: "other", data: "x"})
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{event: "state", data: "10"})
+
+	select {
+	case <-unsubscribedCh:
+		assert.Fail(t, "subscriber should not have been dropped")
+	default:
+	}
+
+	close(w.unblockCh)
+	server.Close()
+	<-doneCh
+	assert.Equal(t, "data: a\n\ndata: b\n\nevent: other\ndata: x\n\nevent: state\ndata: 10\n\n", w.Body.String())
+}
+
+func TestServerCoalesceStillDropsSubscriberWhenQueueIsFull(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	defer server.Close()
+	server.BufferSize = 2
+	server.Coalesce = true
+	connectedCh := make(chan struct{}, 1)
+	server.OnConnect = func(string, string) { connectedCh <- struct{}{} }
+	reasonCh := make(chan DisconnectReason, 1)
+	server.OnDisconnect = func(_ string, reason DisconnectReason) { reasonCh <- reason }
+
+	w := &blockingResponseWriter{ResponseRecorder: httptest.NewRecorder(),
+		writingCh: make(chan struct{}, 1), unblockCh: make(chan struct{})}
+	req, _ := http.NewRequest("GET", "/", nil)
+	go server.Handler(channel).ServeHTTP(w, req)
+	<-connectedCh
+
+	server.Publish([]string{channel}, &publication{data: "a"})
+	<-w.writingCh
+	for _, eventType := range []string{"1", "2", "3", "4"} {
+		<-server.PublishWithAcknowledgment([]string{channel}, &publication{event: eventType})
+	}
+	close(w.unblockCh)
+	assert.Equal(t, DisconnectSlowConsumer, <-reasonCh)
+}
+
+func TestServerDropsEventsOverMaxEventsPerSecond(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.MaxEventsPerSecond = 2
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	for i := 1; i <= 5; i++ {
+		<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: fmt.Sprint(i)})
+	}
+	server.PublishComment([]string{channel}, "not limited")
+	server.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: 1\n\ndata: 2\n\n:not limited\n", string(body))
+}
+
+func TestServerHoldsBackEventsOverMaxEventsPerSecondIfCoalesceRateLimited(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	defer server.Close()
+	server.MaxEventsPerSecond = 10
+	server.CoalesceRateLimited = true
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	for i := 1; i <= 10; i++ {
+		server.Publish([]string{channel}, &publication{event: "state", data: fmt.Sprint(i)})
+	}
+	// These are held back; only the latest event of each type is kept, but every event without a type
+	server.Publish([]string{channel}, &publication{event: "state", data: "11"})
+	server.Publish([]string{channel}, &publication{event: "other", data: "x"})
+	server.Publish([]string{channel}, &publication{data: "u1"})
+	server.Publish([]string{channel}, &publication{event: "state", data: "12"})
+	server.Publish([]string{channel}, &publication{data: "u2"})
+
+	start := time.Now()
+	events, err := ReadEvents(resp.Body, 14)
+	require.NoError(t, err)
+	var data []string
+	for _, ev := range events {
+		data = append(data, ev.Data())
+	}
+	assert.Equal(t, []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "x", "u1", "12", "u2"}, data)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(150*time.Millisecond))
+}
+
+func TestServerReportsDisconnectReasons(t *testing.T) {
+	channel := "test"
+	closedCh := make(chan struct{})
+	close(closedCh)
+
+	for _, tc := range []struct {
+		reason     DisconnectReason
+		configure  func(*Server)
+		w          http.ResponseWriter
+		disconnect func(*Server, context.CancelFunc)
+	}{
+		{DisconnectClientClosed, nil, nil, func(_ *Server, cancel context.CancelFunc) { cancel() }},
+		{DisconnectMaxConnTime, func(s *Server) { s.MaxConnTime = 10 * time.Millisecond }, nil, nil},
+		{DisconnectMaxStreamDuration, func(s *Server) { s.MaxStreamDuration = 10 * time.Millisecond }, nil, nil},
+		{DisconnectServerClosed, nil, nil, func(s *Server, _ context.CancelFunc) { s.Close() }},
+		{DisconnectUnregistered, nil, nil, func(s *Server, _ context.CancelFunc) { s.Unregister(channel, true) }},
+		{DisconnectChannelClosed, nil, nil, func(s *Server, _ context.CancelFunc) { s.CloseChannel(channel) }},
+		{
+			DisconnectWriteError, nil,
+			&blockingResponseWriter{ResponseRecorder: httptest.NewRecorder(), writingCh: make(chan struct{}, 1),
+				unblockCh: closedCh, err: errors.New("broken pipe")},
+			func(s *Server, _ context.CancelFunc) { s.Publish([]string{channel}, &publication{data: "x"}) },
+		},
+	} {
+		t.Run(tc.reason.String(), func(t *testing.T) {
+			server := NewServer()
+			defer func() {
+				if !server.isServerClosed() {
+					server.Close()
+				}
+			}()
+			connectedCh := make(chan struct{}, 1)
+			server.OnConnect = func(string, string) { connectedCh <- struct{}{} }
+			reasonCh := make(chan DisconnectReason, 1)
+			server.OnDisconnect = func(c string, reason DisconnectReason) {
+				assert.Equal(t, channel, c)
+				reasonCh <- reason
+			}
+			if tc.configure != nil {
+				tc.configure(server)
+			}
+
+			w := tc.w
+			if w == nil {
+				w = httptest.NewRecorder()
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, "GET", "/", nil)
+			go server.Handler(channel).ServeHTTP(w, req)
+			<-connectedCh
+			if tc.disconnect != nil {
+				tc.disconnect(server, cancel)
+			}
+
+			select {
+			case reason := <-reasonCh:
+				assert.Equal(t, tc.reason, reason)
+			case <-time.After(time.Second):
+				assert.Fail(t, "timed out waiting for OnDisconnect")
+			}
+		})
+	}
+}
+
+func TestServerDropsSubscriberWhoseFilterPanics(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	defer server.Close()
+	logger := &recordingLogger{}
+	server.Logger = logger
+	reasonCh := make(chan DisconnectReason, 1)
+	server.OnDisconnect = func(_ string, reason DisconnectReason) { reasonCh <- reason }
+	mux := http.NewServeMux()
+	mux.Handle("/panics", server.HandlerWithFilter(channel, func(ev Event) bool { panic("bad filter") }))
+	mux.Handle("/ok", server.Handler(channel))
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	panicsResp, err := http.Get(httpServer.URL + "/panics")
+	require.NoError(t, err)
+	defer panicsResp.Body.Close()
+	okResp, err := http.Get(httpServer.URL + "/ok")
+	require.NoError(t, err)
+	defer okResp.Body.Close()
+
+	server.Publish([]string{channel}, &publication{data: "first"})
+	select {
+	case reason := <-reasonCh:
+		assert.Equal(t, DisconnectPanic, reason)
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting for OnDisconnect")
+	}
+	body, err := ioutil.ReadAll(panicsResp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "", string(body))
+
+	// The Server is still running, and other subscribers still get events.
+	server.Publish([]string{channel}, &publication{data: "second"})
+	events, err := ReadEvents(okResp.Body, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "second", events[1].Data())
+	assert.Equal(t, []string{"eventsource: panic while publishing to a subscriber: bad filter"}, logger.lines)
+}
+
+type panickingRepository struct{}
+
+func (panickingRepository) Replay(channel, id string) chan Event { panic("bad repository") }
+
+func TestServerDropsSubscriberWhoseReplayPanics(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	defer server.Close()
+	logger := &recordingLogger{}
+	server.Logger = logger
+	reasonCh := make(chan DisconnectReason, 1)
+	server.OnDisconnect = func(_ string, reason DisconnectReason) { reasonCh <- reason }
+	server.Register(channel, panickingRepository{})
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	req, _ := http.NewRequest("GET", httpServer.URL, nil)
+	req.Header.Set("Last-Event-Id", "1")
+	panicsResp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer panicsResp.Body.Close()
+	select {
+	case reason := <-reasonCh:
+		assert.Equal(t, DisconnectPanic, reason)
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting for OnDisconnect")
+	}
+
+	// The Server is still running, and subscribers that don't need a replay still get events.
+	okResp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer okResp.Body.Close()
+	server.Publish([]string{channel}, &publication{data: "event"})
+	events, err := ReadEvents(okResp.Body, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "event", events[0].Data())
+	assert.Equal(t, []string{"eventsource: panic while publishing to a subscriber: bad repository"}, logger.lines)
+}
+
+func TestServerSkipsEventWhoseIDGeneratorPanics(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	defer server.Close()
+	logger := &recordingLogger{}
+	server.Logger = logger
+	calls := 0
+	server.IDGenerator = func(string) string {
+		calls++
+		if calls == 1 {
+			panic("bad generator")
+		}
+		return strconv.Itoa(calls)
+	}
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	server.Publish([]string{channel}, &publication{data: "first"})
+	server.Publish([]string{channel}, &publication{data: "second"})
+	events, err := ReadEvents(resp.Body, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "2", events[0].Id())
+	assert.Equal(t, "second", events[0].Data())
+	assert.Equal(t, []string{"eventsource: panic while assigning an ID to an event: bad generator"}, logger.lines)
+}
+
+func TestServerGzipStreamWorksAfterAnotherGzipClientDisconnects(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.Gzip = true
+	endedCh := make(chan struct{}, 1)
+	serverHandler := server.Handler(channel)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		serverHandler.ServeHTTP(w, req)
+		endedCh <- struct{}{}
+	}))
+	defer httpServer.Close()
+
+	subscribe := func(ctx context.Context) *http.Response {
+		req, err := http.NewRequest("GET", httpServer.URL, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", "gzip") // disables the transport's transparent decompression
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		require.NoError(t, err)
+		return resp
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp1 := subscribe(ctx)
+	defer resp1.Body.Close()
+	bigEvent := &publication{data: strings.Repeat("x", 1000000)}
+	server.Publish([]string{channel}, bigEvent)
+	buf := make([]byte, 100)
+	_, err := resp1.Body.Read(buf) // some of the event has been received, but not all of it
+	require.NoError(t, err)
+	cancel()
+	select {
+	case <-endedCh:
+	case <-time.After(time.Second):
+		require.Fail(t, "timed out waiting for handler to end")
+	}
+
+	resp2 := subscribe(context.Background())
+	defer resp2.Body.Close()
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "my-event"})
+	server.Close()
+	r, err := gzip.NewReader(resp2.Body)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(r)
+	require.NoError(t, err) // the stream ends with a gzip trailer, since the client was still connected
+	assert.Equal(t, "data: my-event\n\n", string(body))
+}
+
+type blockingServerRepository struct {
+	name      string
+	startedCh chan struct{}
+	unblockCh chan struct{}
+}
+
+func (r *blockingServerRepository) Replay(channel, id string) chan Event {
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		out <- &publication{id: r.name + "-1", data: "example"}
+		r.startedCh <- struct{}{}
+		<-r.unblockCh
+		out <- &publication{id: r.name + "-2", data: "example"}
+	}()
+	return out
+}
+
+// cursorRepository uses cursors of the form "after-<id>".
+type cursorRepository struct {
+	*SliceRepository
+}
+
+func (r cursorRepository) ReplayFrom(channel, cursor string) chan Event {
+	return r.Replay(channel, strings.TrimPrefix(cursor, "after-"))
+}
+
+func TestServerReplaysFromCursorIfRepositorySupportsIt(t *testing.T) {
+	for _, tc := range []struct {
+		name, query, lastEventID, expected string
+	}{
+		{"cursor", "?cursor=after-1", "", "id: 2\ndata: b\n\nid: 3\ndata: c\n\n"},
+		{"cursor is preferred", "?cursor=after-1", "2", "id: 2\ndata: b\n\nid: 3\ndata: c\n\n"},
+		{"id without cursor", "", "2", "id: 3\ndata: c\n\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			repo := cursorRepository{NewSliceRepository()}
+			repo.Add("test", &publication{id: "1", data: "a"})
+			repo.Add("test", &publication{id: "2", data: "b"})
+			repo.Add("test", &publication{id: "3", data: "c"})
+			server := NewServer()
+			server.Register("test", repo)
+			httpServer := httptest.NewServer(server.Handler("test"))
+			defer httpServer.Close()
+
+			req, _ := http.NewRequest("GET", httpServer.URL+tc.query, nil)
+			if tc.lastEventID != "" {
+				req.Header.Set("Last-Event-ID", tc.lastEventID)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			<-server.PublishWithAcknowledgment([]string{"other"}, &publication{data: "x"})
+			server.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, string(body))
+		})
+	}
+}
+
+func TestServerSwapRepository(t *testing.T) {
+	channel := "test"
+	oldRepo := &blockingServerRepository{name: "old", startedCh: make(chan struct{}, 1), unblockCh: make(chan struct{})}
+	newRepo := &blockingServerRepository{name: "new", startedCh: make(chan struct{}, 1), unblockCh: make(chan struct{})}
+	close(newRepo.unblockCh)
+	server := NewServer()
+	server.ReplayAll = true
+	server.Register(channel, oldRepo)
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp1, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp1.Body.Close()
+	<-oldRepo.startedCh // the first replay is now in progress
+
+	server.SwapRepository(channel, newRepo)
+	resp2, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp2.Body.Close()
+	<-newRepo.startedCh
+
+	close(oldRepo.unblockCh)
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "live"})
+	server.Close()
+
+	body1, err := ioutil.ReadAll(resp1.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "id: old-1\ndata: example\n\nid: old-2\ndata: example\n\ndata: live\n\n", string(body1))
+	body2, err := ioutil.ReadAll(resp2.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "id: new-1\ndata: example\n\nid: new-2\ndata: example\n\ndata: live\n\n", string(body2))
+}
+
+func TestServerHandlerUnsubscribesWhenHTTP2ClientDisconnects(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	unsubscribedCh := make(chan int, 1)
+	server.OnUnsubscribe = func(_ string, count int) { unsubscribedCh <- count }
+	protoCh := make(chan int, 1)
+	serverHandler := server.Handler("test")
+	httpServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		protoCh <- req.ProtoMajor
+		serverHandler.ServeHTTP(w, req)
+	}))
+	httpServer.EnableHTTP2 = true
+	httpServer.StartTLS()
+	defer httpServer.Close()
+
+	req, err := http.NewRequest("GET", httpServer.URL, nil)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := httpServer.Client().Do(req.WithContext(ctx))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 2, <-protoCh)
+
+	cancel() // resets the HTTP/2 stream; the underlying connection stays open
+	select {
+	case count := <-unsubscribedCh:
+		assert.Equal(t, 0, count)
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting for subscription to be removed")
+	}
+}
+
+func TestServerOrderedFanOutDeliversInSubscriptionOrder(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.OrderedFanOut = true
+	defer server.Close()
+	subscribedCh := make(chan struct{}, 1)
+	server.OnSubscribe = func(string, int) { subscribedCh <- struct{}{} }
+
+	var order []string // only accessed from filters, which run on the Server's main goroutine
+	mux := http.NewServeMux()
+	for _, name := range []string{"first", "second", "third"} {
+		name := name
+		mux.Handle("/"+name, server.HandlerWithFilter(channel, func(Event) bool {
+			order = append(order, name)
+			return true
+		}))
+	}
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	for _, name := range []string{"second", "first", "third"} {
+		resp, err := http.Get(httpServer.URL + "/" + name)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		<-subscribedCh
+	}
+
+	for i := 0; i < 20; i++ {
+		<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "x"})
+	}
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, []string{"second", "first", "third"}, order[i*3:i*3+3])
+	}
+}
+
+func TestServerGzipStreamDeliversEachEventPromptly(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.Gzip = true
+	defer server.Close()
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	req, err := http.NewRequest("GET", httpServer.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	// Each event must be decodable as soon as it is published, without waiting for more data or for the
+	// end of the stream; that requires the gzip writer to be flushed before the ResponseWriter.
+	var r io.Reader
+	for _, data := range []string{"first", "second"} {
+		server.Publish([]string{channel}, &publication{data: data})
+		expected := "data: " + data + "\n\n"
+		readCh := make(chan string, 1)
+		go func() {
+			if r == nil {
+				gz, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					readCh <- err.Error()
+					return
+				}
+				r = gz
+			}
+			buf := make([]byte, len(expected))
+			_, err := io.ReadFull(r, buf)
+			if err != nil {
+				readCh <- err.Error()
+				return
+			}
+			readCh <- string(buf)
+		}()
+		select {
+		case s := <-readCh:
+			assert.Equal(t, expected, s)
+		case <-time.After(time.Second):
+			require.Fail(t, "timed out waiting for compressed event")
+		}
+	}
+}
+
+func TestServerNegotiatesBrotli(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.Gzip = true
+	server.Brotli = true
+	defer server.Close()
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	for _, tc := range []struct {
+		acceptEncoding  string
+		contentEncoding string
+	}{
+		{"gzip, br;q=0.9", "br"},
+		{"gzip", "gzip"},
+		{"identity", ""},
+		{"gzip, br;q=0", "gzip"},
+		{"br; q=0.0, gzip;q=0.5", "gzip"},
+		{"BR", "br"},
+		{"br;q=0, gzip;q=0", ""},
+	} {
+		t.Run(tc.acceptEncoding, func(t *testing.T) {
+			req, err := http.NewRequest("GET", httpServer.URL, nil)
+			require.NoError(t, err)
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tc.contentEncoding, resp.Header.Get("Content-Encoding"))
+		})
+	}
+}
+
+func TestServerBrotliStreamDeliversEachEventPromptly(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	server.Brotli = true
+	defer server.Close()
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	req, err := http.NewRequest("GET", httpServer.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "br")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+
+	r := brotli.NewReader(resp.Body)
+	for _, data := range []string{"first", "second"} {
+		server.Publish([]string{channel}, &publication{data: data})
+		expected := "data: " + data + "\n\n"
+		readCh := make(chan string, 1)
+		go func() {
+			buf := make([]byte, len(expected))
+			if _, err := io.ReadFull(r, buf); err != nil {
+				readCh <- err.Error()
+				return
+			}
+			readCh <- string(buf)
+		}()
+		select {
+		case s := <-readCh:
+			assert.Equal(t, expected, s)
+		case <-time.After(time.Second):
+			require.Fail(t, "timed out waiting for compressed event")
+		}
+	}
+}
+
+func TestServerHandlerEnforcesMaxSubscribersPerChannel(t *testing.T) {
+	server := NewServer()
+	server.MaxSubscribersPerChannel = 1
+	defer server.Close()
+	unsubscribedCh := make(chan struct{}, 10)
+	server.OnUnsubscribe = func(string, int) { unsubscribedCh <- struct{}{} }
+	mux := http.NewServeMux()
+	mux.Handle("/a", server.Handler("a"))
+	mux.Handle("/b", server.Handler("b"))
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest("GET", httpServer.URL+"/a", nil)
+	require.NoError(t, err)
+	resp1, err := http.DefaultClient.Do(req.WithContext(ctx))
+	require.NoError(t, err)
+	defer resp1.Body.Close()
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+
+	resp2, err := http.Get(httpServer.URL + "/a")
+	require.NoError(t, err)
+	defer resp2.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp2.StatusCode)
+
+	resp3, err := http.Get(httpServer.URL + "/b") // the limit is per channel
+	require.NoError(t, err)
+	defer resp3.Body.Close()
+	assert.Equal(t, http.StatusOK, resp3.StatusCode)
+
+	cancel()
+	<-unsubscribedCh
+	resp4, err := http.Get(httpServer.URL + "/a")
+	require.NoError(t, err)
+	defer resp4.Body.Close()
+	assert.Equal(t, http.StatusOK, resp4.StatusCode)
+}
+
+func TestServerHandlerEnforcesMaxChannels(t *testing.T) {
+	server := NewServer()
+	server.MaxChannels = 2
+	defer server.Close()
+	unsubscribedCh := make(chan int, 10)
+	server.OnUnsubscribe = func(_ string, count int) { unsubscribedCh <- count }
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		server.Handler(req.URL.Path[1:])(w, req)
+	}))
+	defer httpServer.Close()
+
+	get := func(ctx context.Context, channel string) *http.Response {
+		req, err := http.NewRequest("GET", httpServer.URL+"/"+channel, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		require.NoError(t, err)
+		return resp
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	respA := get(ctx, "a")
+	defer respA.Body.Close()
+	respB := get(context.Background(), "b")
+	defer respB.Body.Close()
+	assert.Equal(t, http.StatusOK, respB.StatusCode)
+
+	respC := get(context.Background(), "c")
+	respC.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, respC.StatusCode)
+
+	respB2 := get(context.Background(), "b") // the channel already has subscribers, so it doesn't count again
+	defer respB2.Body.Close()
+	assert.Equal(t, http.StatusOK, respB2.StatusCode)
+
+	// Once a channel's last subscriber has gone, it no longer counts toward the limit.
+	cancel()
+	assert.Equal(t, 0, <-unsubscribedCh)
+	respC = get(context.Background(), "c")
+	defer respC.Body.Close()
+	assert.Equal(t, http.StatusOK, respC.StatusCode)
+}
+
+func TestServerForgetsChannelsAfterSubscriberChurn(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	// With a limit of one channel, each new channel can only be subscribed to if the previous one was
+	// removed once its subscriber had gone.
+	server.MaxChannels = 1
+	connectedCh := make(chan struct{}, 1)
+	server.OnConnect = func(string, string) { connectedCh <- struct{}{} }
+	unsubscribedCh := make(chan int, 1)
+	server.OnUnsubscribe = func(_ string, count int) { unsubscribedCh <- count }
+
+	for i := 0; i < 50; i++ {
+		channel := fmt.Sprintf("transient-%d", i)
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequest("GET", "/", nil)
+		go server.Handler(channel).ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+		select {
+		case <-connectedCh:
+		case <-time.After(time.Second):
+			require.Fail(t, "timed out waiting for subscription", "channel %d", i)
+		}
+		cancel()
+		assert.Equal(t, 0, <-unsubscribedCh)
+	}
+}
+
+func TestServerReportsUndeliveredEvents(t *testing.T) {
+	for _, coalesce := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Coalesce %t", coalesce), func(t *testing.T) {
+			channel := "test"
+			server := NewServer()
+			defer server.Close()
+			server.Coalesce = coalesce // if set, the waiting events are in the coalescingQueue instead of eventCh
+			connectedCh := make(chan struct{}, 1)
+			server.OnConnect = func(string, string) { connectedCh <- struct{}{} }
+			var undelivered []string
+			server.OnUndelivered = func(c string, ev Event) {
+				assert.Equal(t, channel, c)
+				undelivered = append(undelivered, ev.Data())
+			}
+
+			w := &blockingResponseWriter{ResponseRecorder: httptest.NewRecorder(),
+				writingCh: make(chan struct{}, 1), unblockCh: make(chan struct{}), err: errors.New("broken pipe")}
+			req, _ := http.NewRequest("GET", "/", nil)
+			doneCh := make(chan struct{})
+			go func() {
+				server.Handler(channel).ServeHTTP(w, req)
+				close(doneCh)
+			}()
+			<-connectedCh
+
+			server.Publish([]string{channel}, &publication{data: "1"})
+			<-w.writingCh
+			server.PublishComment([]string{channel}, "not an event")
+			<-server.PublishWithAcknowledgment([]string{channel}, &publication{data: "2"})
+			<-server.PublishWithAcknowledgment([]string{channel}, &publication{event: "state", data: "3"})
+			close(w.unblockCh) // the write of the first event fails
+			<-doneCh
+
+			assert.Equal(t, []string{"1", "2", "3"}, undelivered)
+		})
+	}
+}
+
+func TestServerDoesNotReportGeneratedEventsAsUndelivered(t *testing.T) {
+	channel := "test"
+	server := NewServer()
+	defer server.Close()
+	server.ReplayAll = true
+	server.SendCaughtUp = true
+	server.Register(channel, NewSliceRepository())
+	var undelivered []string
+	server.OnUndelivered = func(_ string, ev Event) { undelivered = append(undelivered, ev.Event()) }
+	reasonCh := make(chan DisconnectReason, 1)
+	server.OnDisconnect = func(_ string, reason DisconnectReason) { reasonCh <- reason }
+
+	// Every write fails, so the first one is the "_caught_up" event at the end of the empty replay.
+	w := &blockingResponseWriter{ResponseRecorder: httptest.NewRecorder(),
+		writingCh: make(chan struct{}, 1), unblockCh: make(chan struct{}), err: errors.New("broken pipe")}
+	close(w.unblockCh)
+	req, _ := http.NewRequest("GET", "/", nil)
+	server.Handler(channel).ServeHTTP(w, req)
+
+	assert.Equal(t, DisconnectWriteError, <-reasonCh)
+	assert.Len(t, w.writingCh, 1)
+	assert.Empty(t, undelivered)
+}
+
+func TestServerSendsCaughtUpEventAfterReplay(t *testing.T) {
+	channel := "test"
+	repo := NewSliceRepository()
+	repo.Add(channel, &publication{id: "1", data: "a"})
+	repo.Add(channel, &publication{id: "2", data: "b"})
+	server := NewServer()
+	server.ReplayAll = true
+	server.SendCaughtUp = true
+	server.Register(channel, repo)
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{id: "3", data: "c"})
+	server.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "id: 1\ndata: a\n\nid: 2\ndata: b\n\nevent: _caught_up\ndata: 2\n\nid: 3\ndata: c\n\n", string(body))
+}
+
+func TestServerSendsReplayDoneEventAfterReplay(t *testing.T) {
+	channel := "test"
+	repo := NewSliceRepository()
+	repo.Add(channel, &publication{id: "1", data: "a"})
+	repo.Add(channel, &publication{id: "2", data: "b"})
+	server := NewServer()
+	server.ReplayDoneEvent = "replay-complete"
+	server.Register(channel, repo)
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	req, err := http.NewRequest("GET", httpServer.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-Id", "1")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{id: "3", data: "c"})
+	server.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "id: 2\ndata: b\n\nevent: replay-complete\ndata: 2\n\nid: 3\ndata: c\n\n", string(body))
+}
+
+// nilReplayRepository has no history, and says so by returning nil from Replay, as the Repository
+// interface allows.
+type nilReplayRepository struct{}
+
+func (nilReplayRepository) Replay(channel, id string) chan Event { return nil }
+
+func TestServerSendsReplayEndEventsWhenNothingIsReplayed(t *testing.T) {
+	for name, repo := range map[string]Repository{"no repository": nil, "nil replay": nilReplayRepository{}} {
+		t.Run(name, func(t *testing.T) {
+			channel := "test"
+			server := NewServer()
+			server.SendCaughtUp = true
+			server.ReplayDoneEvent = "replay-complete"
+			if repo != nil {
+				server.Register(channel, repo)
+			}
+			httpServer := httptest.NewServer(server.Handler(channel))
+			defer httpServer.Close()
+
+			req, err := http.NewRequest("GET", httpServer.URL, nil)
+			require.NoError(t, err)
+			req.Header.Set("Last-Event-Id", "5")
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			<-server.PublishWithAcknowledgment([]string{channel}, &publication{id: "6", data: "f"})
+			server.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "event: _caught_up\ndata: 5\n\nevent: replay-complete\ndata: 5\n\nid: 6\ndata: f\n\n",
+				string(body))
+		})
+	}
+}
+
+func TestServerDeliversReplayedEventsBeforeLiveEvents(t *testing.T) {
+	channel := "test"
+	repo := &blockingServerRepository{name: "replayed", startedCh: make(chan struct{}, 1), unblockCh: make(chan struct{})}
+	server := NewServer()
+	server.Register(channel, repo)
+	httpServer := httptest.NewServer(server.Handler(channel))
+	defer httpServer.Close()
+
+	req, err := http.NewRequest("GET", httpServer.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-Id", "0")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	<-repo.startedCh
+
+	// These are published while the replay is still in progress, so they must be held until it ends.
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{id: "live-1", data: "live"})
+	<-server.PublishWithAcknowledgment([]string{channel}, &publication{id: "live-2", data: "live"})
+	close(repo.unblockCh)
+	server.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "id: replayed-1\ndata: example\n\nid: replayed-2\ndata: example\n\n"+
+		"id: live-1\ndata: live\n\nid: live-2\ndata: live\n\n", string(body))
+}
+
+func TestServerBufferReplayCompressesReplayAndStillDeliversLiveEventsPromptly(t *testing.T) {
+	channel := "test"
+	repo := NewSliceRepository()
+	for i := 0; i < 100; i++ {
+		repo.Add(channel, &publication{id: fmt.Sprintf("%03d", i), data: `{"key":"value","other":"value"}`})
+	}
+	replayedText := ""
+	for ev := range repo.Replay(channel, "") {
+		replayedText += "id: " + ev.Id() + "\ndata: " + ev.Data() + "\n\n"
+	}
+
+	// Returns the number of compressed bytes in the replay, after checking that a live event published
+	// after the replay can be read without waiting for the stream to end.
+	doTest := func(t *testing.T, bufferReplay bool) int {
+		server := NewServer()
+		server.Gzip = true
+		server.ReplayAll = true
+		server.BufferReplay = bufferReplay
+		server.Register(channel, repo)
+		defer server.Close()
+		httpServer := httptest.NewServer(server.Handler(channel))
+		defer httpServer.Close()
+
+		req, err := http.NewRequest("GET", httpServer.URL, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		counter := &countingReader{r: resp.Body}
+		gz, err := gzip.NewReader(counter)
+		require.NoError(t, err)
+		replayed := make([]byte, len(replayedText))
+		_, err = io.ReadFull(gz, replayed)
+		require.NoError(t, err)
+		assert.Equal(t, replayedText, string(replayed))
+		compressedSize := counter.n
+
+		server.Publish([]string{channel}, &publication{data: "live"})
+		readCh := make(chan string, 1)
+		go func() {
+			live := make([]byte, len("data: live\n\n"))
+			_, _ = io.ReadFull(gz, live)
+			readCh <- string(live)
+		}()
+		select {
+		case live := <-readCh:
+			assert.Equal(t, "data: live\n\n", live)
+		case <-time.After(time.Second):
+			assert.Fail(t, "timed out waiting for live event")
+		}
+		return compressedSize
+	}
+
+	unbufferedSize := doTest(t, false)
+	bufferedSize := doTest(t, true)
+	assert.Less(t, bufferedSize*2, unbufferedSize)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestServerHandlersReturnWhenClientsDisconnectWhileServerCloses(t *testing.T) {
+	server := NewServer()
+	// Slowing down the Server's main goroutine means that unsubscriptions are still queued when it quits.
+	server.OnUnsubscribe = func(string, int) { time.Sleep(10 * time.Millisecond) }
+	connectedCh := make(chan struct{}, 50)
+	server.OnConnect = func(string, string) { connectedCh <- struct{}{} }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < cap(connectedCh); i++ {
+		req, err := http.NewRequest("GET", "/", nil)
+		require.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Handler("test").ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+		}()
+		<-connectedCh
+	}
+
+	cancel()
+	server.Close()
+	doneCh := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "timed out waiting for handlers to return")
+	}
+}
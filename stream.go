@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -32,6 +33,7 @@ type Stream struct {
 	// not used and will be nil.
 	Errors       chan error
 	errorHandler StreamErrorHandler
+	gapHandler   func(expected, got string)
 	// Logger is a logger that, when set, will be used for logging informational messages.
 	//
 	// This field is exported for backward compatibility, but should not be set directly because
@@ -182,6 +184,7 @@ func newStream(request *http.Request, configuredOptions streamOptions) *Stream {
 		retryDelay:   retryDelay,
 		Events:       make(chan Event),
 		errorHandler: configuredOptions.errorHandler,
+		gapHandler:   configuredOptions.gapHandler,
 		Logger:       configuredOptions.logger,
 		restarter:    make(chan struct{}, 1),
 		closer:       make(chan struct{}),
@@ -286,6 +289,10 @@ func (stream *Stream) stream(r io.ReadCloser) {
 		return true
 	}
 
+	// After a reconnection, if there is a gap handler, this is the numeric ID of the last event that was seen
+	// before the reconnection; it is cleared once the first new event has been checked.
+	var gapCheckFrom *int64
+
 NewStream:
 	for {
 		events := make(chan Event)
@@ -341,6 +348,16 @@ NewStream:
 				if pub.Retry() > 0 {
 					stream.retryDelay.SetBaseDelay(time.Duration(pub.Retry()) * time.Millisecond)
 				}
+				if gapCheckFrom != nil && pub.Id() != "" {
+					if id, err := strconv.ParseInt(pub.Id(), 10, 64); err != nil {
+						gapCheckFrom = nil
+					} else if id > *gapCheckFrom {
+						if expected := *gapCheckFrom + 1; id != expected {
+							stream.gapHandler(strconv.FormatInt(expected, 10), pub.Id())
+						}
+						gapCheckFrom = nil
+					}
+				}
 				stream.lastEventID = pub.lastEventID
 				stream.retryDelay.SetGoodSince(time.Now())
 				stream.Events <- ev
@@ -356,6 +373,11 @@ NewStream:
 						break NewStream
 					}
 					scheduleRetry()
+				} else if stream.gapHandler != nil {
+					gapCheckFrom = nil
+					if id, err := strconv.ParseInt(stream.lastEventID, 10, 64); err == nil {
+						gapCheckFrom = &id
+					}
 				}
 				continue NewStream
 			}
@@ -16,6 +16,7 @@ type streamOptions struct {
 	retryResetInterval  time.Duration
 	initialRetryTimeout time.Duration
 	errorHandler        StreamErrorHandler
+	gapHandler          func(expected, got string)
 }
 
 // StreamOption is a common interface for optional configuration parameters that can be
@@ -37,6 +38,11 @@ func (o readTimeoutOption) apply(s *streamOptions) error {
 // stream when the stream is created. If the stream does not receive new data within this
 // length of time, it will restart the connection.
 //
+// Both events and comments count as new data, so this can be used to detect a server that
+// has stopped sending its keep-alive comments, and reconnect without waiting for the TCP
+// connection to time out. The timeout should be somewhat longer than the server's keep-alive
+// interval. The restart is reported on the Errors channel as ErrReadTimeout.
+//
 // By default, there is no read timeout.
 func StreamOptionReadTimeout(timeout time.Duration) StreamOption {
 	return readTimeoutOption{timeout: timeout}
@@ -235,6 +241,28 @@ func StreamOptionErrorHandler(handler StreamErrorHandler) StreamOption {
 	return streamErrorHandlerOption{handler}
 }
 
+type gapHandlerOption struct {
+	handler func(expected, got string)
+}
+
+func (o gapHandlerOption) apply(s *streamOptions) error {
+	s.gapHandler = o.handler
+	return nil
+}
+
+// StreamOptionOnGap returns an option that causes a Stream to call the specified function if it
+// detects that events were missed while it was reconnecting, so that the application can fetch the
+// missing data some other way, for instance if the server has no Repository to replay events from.
+//
+// Gaps can only be detected if event IDs are consecutive integers. After each reconnection, the Stream
+// compares the ID of the first new event (ignoring any replayed events with IDs up to and including the
+// last one it had seen) to the ID that should have followed the last one it had seen. If they differ,
+// the function is called with the expected ID and the ID that was actually received. It is called on
+// the Stream's worker goroutine, before the event is delivered, and should return promptly.
+func StreamOptionOnGap(handler func(expected, got string)) StreamOption {
+	return gapHandlerOption{handler}
+}
+
 const (
 	// DefaultInitialRetry is the default value for StreamOptionalInitialRetry.
 	DefaultInitialRetry = time.Second * 3
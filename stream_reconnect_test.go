@@ -167,3 +167,47 @@ func TestStreamBackoffCanUseResetInterval(t *testing.T) {
 	d2 := retry.NextRetryDelay(time.Now().Add(resetInterval))
 	assert.Equal(t, baseDelay, d2)
 }
+
+func TestStreamReportsGapAfterReconnecting(t *testing.T) {
+	doTest := func(t *testing.T, eventsAfterReconnect []string, expectedGaps []string) {
+		streamHandler, streamControl := httphelpers.SSEHandler(nil)
+		defer streamControl.Close()
+		httpServer := httptest.NewServer(streamHandler)
+		defer httpServer.Close()
+
+		gapsCh := make(chan string, 10)
+		stream := mustSubscribe(t, httpServer.URL, StreamOptionInitialRetry(time.Millisecond),
+			StreamOptionOnGap(func(expected, got string) { gapsCh <- expected + "->" + got }))
+		defer stream.Close()
+
+		streamControl.Enqueue(httphelpers.SSEEvent{ID: "1"})
+		streamControl.Enqueue(httphelpers.SSEEvent{ID: "2"})
+		for i := 0; i < 2; i++ {
+			<-stream.Events
+		}
+		streamControl.EndAll()
+		<-stream.Errors
+
+		for _, id := range eventsAfterReconnect {
+			streamControl.Enqueue(httphelpers.SSEEvent{ID: id})
+		}
+		for range eventsAfterReconnect {
+			select {
+			case <-stream.Events:
+			case <-stream.Errors:
+			case <-time.After(2 * time.Second):
+				t.Fatal("Timed out waiting for event")
+			}
+		}
+		close(gapsCh)
+		var gaps []string
+		for g := range gapsCh {
+			gaps = append(gaps, g)
+		}
+		assert.Equal(t, expectedGaps, gaps)
+	}
+
+	t.Run("gap", func(t *testing.T) { doTest(t, []string{"5", "6"}, []string{"3->5"}) })
+	t.Run("no gap", func(t *testing.T) { doTest(t, []string{"3", "5"}, nil) })
+	t.Run("no gap after replayed events", func(t *testing.T) { doTest(t, []string{"1", "2", "3"}, nil) })
+}
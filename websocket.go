@@ -0,0 +1,261 @@
+package eventsource
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1" //nolint:gosec // required by the WebSocket protocol, not used for security
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The GUID that RFC 6455 combines with the client's Sec-WebSocket-Key to prove that the server understood
+// the handshake.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	webSocketOpText  = 0x1
+	webSocketOpClose = 0x8
+	webSocketOpPing  = 0x9
+	webSocketOpPong  = 0xA
+)
+
+// WebSocketHandler creates a handler for a channel that can deliver events over a WebSocket connection, for
+// clients behind proxies that break server-sent events. A request that asks to upgrade to a WebSocket gets
+// the same events as one to Handler, and is subject to the same Server options other than StrictAccept, but
+// each event is sent as a WebSocket text message containing the event in text/event-stream format, without
+// compression. If FlushInterval or BufferReplay is set, a message may contain several events. Any other
+// request is handled exactly as by Handler, so the same URL can serve both kinds of client.
+//
+// A request that the Server rejects, for instance because of Authorize or MaxSubscribersPerChannel, gets an
+// ordinary HTTP error response rather than being upgraded. Messages from the client are ignored, except
+// that a close message ends the subscription, and a ping is answered with a pong.
+//
+// Browsers don't apply CORS to WebSockets, so any page could otherwise open one with the user's cookies and
+// read the stream. An upgrade request whose Origin header names a different host than the request's Host
+// header is therefore rejected with HTTP 403, unless AllowCORS is set or the origin is in AllowedOrigins.
+func (srv *Server) WebSocketHandler(channel string) http.HandlerFunc {
+	handler := srv.Handler(channel)
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !isWebSocketUpgrade(req) {
+			handler(w, req)
+			return
+		}
+		if req.Header.Get("Sec-WebSocket-Version") != "13" || req.Header.Get("Sec-WebSocket-Key") == "" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(w, "unsupported WebSocket handshake", http.StatusBadRequest)
+			return
+		}
+		if !srv.isWebSocketOriginAllowed(req) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		if _, ok := w.(http.Hijacker); !ok {
+			if srv.Logger != nil {
+				srv.Logger.Println("eventsource: ResponseWriter does not implement http.Hijacker, cannot upgrade to WebSocket")
+			}
+			http.Error(w, "WebSocket is not supported by this ResponseWriter", http.StatusInternalServerError)
+			return
+		}
+
+		// The connection isn't upgraded until the handler accepts the subscription by writing a 200 status.
+		// After that, the handler's context is cancelled when the client closes the WebSocket.
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		wsReq := req.WithContext(ctx)
+		wsReq.Header = req.Header.Clone()
+		wsReq.Header.Del("Accept-Encoding")
+		// Browsers don't list text/event-stream in a handshake's Accept header, but that is what the messages
+		// contain, so the upgrade is not refused by StrictAccept.
+		wsReq.Header.Set("Accept", "text/event-stream")
+		ws := &webSocketWriter{ResponseWriter: w, key: req.Header.Get("Sec-WebSocket-Key"), cancel: cancel}
+		handler(ws, wsReq)
+		if ws.conn != nil {
+			ws.Flush()
+			_ = ws.writeFrame(webSocketOpClose, nil)
+			ws.conn.Close()
+		}
+	}
+}
+
+// Returns true if a WebSocket upgrade request has no Origin header, or if its origin is the request's own
+// host or is allowed by AllowCORS or AllowedOrigins.
+func (srv *Server) isWebSocketOriginAllowed(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" || srv.AllowCORS {
+		return true
+	}
+	if len(srv.AllowedOrigins) > 0 && srv.isOriginAllowed(origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Host)
+}
+
+func isWebSocketUpgrade(req *http.Request) bool {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range strings.Split(req.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// webSocketWriter is the http.ResponseWriter that WebSocketHandler passes to the Server's handler. Until a
+// 200 status is written, it passes everything through to the real ResponseWriter. After that, it collects
+// what is written and sends it as a text message each time it is flushed.
+type webSocketWriter struct {
+	http.ResponseWriter
+	key         string
+	cancel      func()
+	wroteHeader bool
+	conn        net.Conn   // set once the connection has been upgraded
+	writeLock   sync.Mutex // held while writing a frame, since pongs are written by the reading goroutine
+	buf         []byte
+	err         error // the error from the last message, which is returned by the next Write
+}
+
+func (ws *webSocketWriter) WriteHeader(status int) {
+	if ws.wroteHeader {
+		return
+	}
+	ws.wroteHeader = true
+	if status != http.StatusOK {
+		ws.ResponseWriter.WriteHeader(status)
+		return
+	}
+	conn, rw, err := ws.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		ws.err = err
+		ws.cancel()
+		return
+	}
+	ws.conn = conn
+	accept := sha1.Sum([]byte(ws.key + webSocketGUID)) //nolint:gosec // see import
+	_, ws.err = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n")
+	if ws.err == nil {
+		ws.err = rw.Flush()
+	}
+	go func() {
+		ws.readFrames(rw.Reader)
+		ws.cancel()
+	}()
+}
+
+func (ws *webSocketWriter) Write(p []byte) (int, error) {
+	if !ws.wroteHeader {
+		ws.WriteHeader(http.StatusOK)
+	}
+	if ws.conn == nil && ws.err == nil {
+		return ws.ResponseWriter.Write(p) // an error response
+	}
+	if ws.err != nil {
+		return 0, ws.err
+	}
+	ws.buf = append(ws.buf, p...)
+	return len(p), nil
+}
+
+func (ws *webSocketWriter) Flush() {
+	if ws.conn == nil || ws.err != nil || len(ws.buf) == 0 {
+		return
+	}
+	ws.err = ws.writeFrame(webSocketOpText, ws.buf)
+	ws.buf = ws.buf[:0]
+}
+
+// SetWriteDeadline lets the Server's WriteTimeout apply to the WebSocket connection.
+func (ws *webSocketWriter) SetWriteDeadline(deadline time.Time) error {
+	if ws.conn == nil {
+		return setWriteDeadline(ws.ResponseWriter, deadline)
+	}
+	return ws.conn.SetWriteDeadline(deadline)
+}
+
+// writeFrame writes an unfragmented frame. Frames sent by a server are not masked.
+func (ws *webSocketWriter) writeFrame(opcode byte, payload []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode // FIN bit, since messages are never fragmented
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	_, err := ws.conn.Write(append(header, payload...))
+	return err
+}
+
+// readFrames reads frames from the client, answers pings, and discards anything else. It returns when the
+// client sends a close frame or the connection fails.
+func (ws *webSocketWriter) readFrames(r *bufio.Reader) {
+	header := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return
+		}
+		opcode := header[0] & 0x0F
+		if opcode == webSocketOpClose {
+			return
+		}
+		n := int64(header[1] & 0x7F)
+		switch n {
+		case 126:
+			ext := make([]byte, 2)
+			if _, err := io.ReadFull(r, ext); err != nil {
+				return
+			}
+			n = int64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(r, ext); err != nil {
+				return
+			}
+			n = int64(binary.BigEndian.Uint64(ext))
+		}
+		var mask []byte
+		if header[1]&0x80 != 0 {
+			mask = make([]byte, 4)
+			if _, err := io.ReadFull(r, mask); err != nil {
+				return
+			}
+		}
+		if opcode != webSocketOpPing || n > 125 { // control frames can't be longer, so it's invalid anyway
+			if _, err := io.CopyN(ioutil.Discard, r, n); err != nil {
+				return
+			}
+			continue
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		if mask != nil {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+		if ws.writeFrame(webSocketOpPong, payload) != nil {
+			return
+		}
+	}
+}
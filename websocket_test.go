@@ -0,0 +1,190 @@
+package eventsource
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dialWebSocket makes a WebSocket handshake request to url, and returns the connection and the response.
+// If origin is not empty, it is sent in the Origin header.
+func dialWebSocket(t *testing.T, url, origin string) (net.Conn, *bufio.Reader, *http.Response) {
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==") // the example from RFC 6455
+	conn, err := net.Dial("tcp", req.URL.Host)
+	require.NoError(t, err)
+	require.NoError(t, req.Write(conn))
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	require.NoError(t, err)
+	return conn, r, resp
+}
+
+// readWebSocketFrame reads an unmasked frame sent by the server.
+func readWebSocketFrame(t *testing.T, r io.Reader) (byte, string) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	require.NoError(t, err)
+	require.Equal(t, byte(0), header[1]&0x80, "server frames must not be masked")
+	n := int(header[1])
+	if n == 126 {
+		ext := make([]byte, 2)
+		_, err = io.ReadFull(r, ext)
+		require.NoError(t, err)
+		n = int(binary.BigEndian.Uint16(ext))
+	}
+	payload := make([]byte, n)
+	_, err = io.ReadFull(r, payload)
+	require.NoError(t, err)
+	return header[0], string(payload)
+}
+
+func TestWebSocketHandlerDeliversEventsAsTextMessages(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	disconnectedCh := make(chan DisconnectReason, 1)
+	server.OnDisconnect = func(_ string, reason DisconnectReason) { disconnectedCh <- reason }
+	httpServer := httptest.NewServer(server.WebSocketHandler("test"))
+	defer httpServer.Close()
+
+	conn, r, resp := dialWebSocket(t, httpServer.URL, "")
+	defer conn.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+
+	server.Publish([]string{"test"}, &publication{id: "1", event: "greeting", data: "hello"})
+	long := strings.Repeat("x", 200)
+	server.Publish([]string{"test"}, &publication{data: long})
+
+	op, payload := readWebSocketFrame(t, r)
+	assert.Equal(t, byte(0x81), op)
+	assert.Equal(t, "id: 1\nevent: greeting\ndata: hello\n\n", payload)
+	_, payload = readWebSocketFrame(t, r)
+	assert.Equal(t, "data: "+long+"\n\n", payload)
+
+	// A close frame from the client, masked with an all-zero key, ends the subscription.
+	_, err := conn.Write([]byte{0x88, 0x80, 0, 0, 0, 0})
+	require.NoError(t, err)
+	select {
+	case reason := <-disconnectedCh:
+		assert.Equal(t, DisconnectClientClosed, reason)
+	case <-time.After(time.Second):
+		assert.Fail(t, "timed out waiting for disconnection")
+	}
+	op, _ = readWebSocketFrame(t, r)
+	assert.Equal(t, byte(0x88), op)
+}
+
+func TestWebSocketHandlerServesOrdinaryRequestsAsEventStream(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	httpServer := httptest.NewServer(server.WebSocketHandler("test"))
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	server.Publish([]string{"test"}, &publication{data: "hello"})
+	events, err := ReadEvents(resp.Body, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", events[0].Data())
+}
+
+func TestWebSocketHandlerRejectsUnauthorizedRequestWithoutUpgrading(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.Authorize = func(*http.Request, string) error { return io.EOF }
+	httpServer := httptest.NewServer(server.WebSocketHandler("test"))
+	defer httpServer.Close()
+
+	conn, _, resp := dialWebSocket(t, httpServer.URL, "")
+	defer conn.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "Forbidden\n", string(body))
+}
+
+func TestWebSocketHandlerAnswersPings(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	httpServer := httptest.NewServer(server.WebSocketHandler("test"))
+	defer httpServer.Close()
+
+	conn, r, resp := dialWebSocket(t, httpServer.URL, "")
+	defer conn.Close()
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	// A ping with the payload "hi", masked with the key 1, 2, 3, 4
+	_, err := conn.Write([]byte{0x89, 0x82, 1, 2, 3, 4, 'h' ^ 1, 'i' ^ 2})
+	require.NoError(t, err)
+	op, payload := readWebSocketFrame(t, r)
+	assert.Equal(t, byte(0x8A), op)
+	assert.Equal(t, "hi", payload)
+}
+
+func TestWebSocketHandlerUpgradesWithStrictAccept(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.StrictAccept = true
+	httpServer := httptest.NewServer(server.WebSocketHandler("test"))
+	defer httpServer.Close()
+
+	conn, r, resp := dialWebSocket(t, httpServer.URL, "") // without text/event-stream in an Accept header
+	defer conn.Close()
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	server.Publish([]string{"test"}, &publication{id: "1", data: "hello"})
+	_, payload := readWebSocketFrame(t, r)
+	assert.Equal(t, "id: 1\ndata: hello\n\n", payload)
+}
+
+func TestWebSocketHandlerChecksOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		allowCORS      bool
+		allowedOrigins []string
+		origin         string
+		status         int
+	}{
+		{"no origin", false, nil, "", http.StatusSwitchingProtocols},
+		{"same origin", false, nil, "http://HOST", http.StatusSwitchingProtocols},
+		{"other origin", false, nil, "https://evil.example", http.StatusForbidden},
+		{"other origin with AllowCORS", true, nil, "https://evil.example", http.StatusSwitchingProtocols},
+		{"allowed origin", false, []string{"https://app.example"}, "https://app.example", http.StatusSwitchingProtocols},
+		{"origin not in AllowedOrigins", false, []string{"https://app.example"}, "https://evil.example",
+			http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer()
+			defer server.Close()
+			server.AllowCORS = tc.allowCORS
+			server.AllowedOrigins = tc.allowedOrigins
+			httpServer := httptest.NewServer(server.WebSocketHandler("test"))
+			defer httpServer.Close()
+
+			origin := strings.Replace(tc.origin, "HOST", strings.TrimPrefix(httpServer.URL, "http://"), 1)
+			conn, _, resp := dialWebSocket(t, httpServer.URL, origin)
+			defer conn.Close()
+			assert.Equal(t, tc.status, resp.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !go1.20
+// +build !go1.20
+
+package eventsource
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+var errWriteDeadlineNotSupported = errors.New("ResponseWriter does not support write deadlines")
+
+// Before go1.20 there is no http.ResponseController, so we can only set a deadline if the ResponseWriter
+// provides the method itself.
+func setWriteDeadline(w http.ResponseWriter, deadline time.Time) error {
+	if d, ok := w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(deadline)
+	}
+	return errWriteDeadlineNotSupported
+}
@@ -0,0 +1,13 @@
+//go:build go1.20
+// +build go1.20
+
+package eventsource
+
+import (
+	"net/http"
+	"time"
+)
+
+func setWriteDeadline(w http.ResponseWriter, deadline time.Time) error {
+	return http.NewResponseController(w).SetWriteDeadline(deadline)
+}